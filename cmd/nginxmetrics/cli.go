@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"mxmz.it/nginxmetrics/input"
+	"mxmz.it/nginxmetrics/logging"
+)
+
+// Exit codes
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+type options struct {
+	configPath     string
+	listen         string
+	tlsCert        string
+	tlsKey         string
+	logLevel       string
+	subsystems     string
+	watchConfig    bool
+	fileGrace      time.Duration
+	checkpointFile string
+	maxCatchUp     int64
+	backfill       time.Duration
+	server         *ServerConfig
+	reloader       *reloader
+	format         string
+	timeField      string
+	input          int
+	stdin          io.Reader
+	stdout         io.Writer
+	stderr         io.Writer
+}
+
+// command is a subcommand of nginxmetrics. Offline commands only read the
+// config: they have no HTTP endpoint and are not reloaded. Commands reading
+// inputs need no args when the config has an inputs section.
+type command struct {
+	name          string
+	args          string
+	summary       string
+	defaultListen string
+	run           func(config *config, opts *options, args []string) error
+	optionalArgs  bool
+	inputs        bool
+	offline       bool
+	flags         func(fs *flag.FlagSet, opts *options)
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:          "standard",
+			args:          "FILE_GLOB...",
+			summary:       "export metrics computed from access and error logs",
+			defaultListen: ":9802",
+			run:           doStandardMetrics,
+			inputs:        true,
+		},
+		{
+			name:          "unique",
+			args:          "FILE_GLOB...",
+			summary:       "export unique value counters computed from access logs",
+			defaultListen: ":9803",
+			run:           doUniqueMetrics,
+			inputs:        true,
+		},
+		{
+			name:          "nel",
+			summary:       "receive Network Error Logging and CSP reports",
+			defaultListen: ":10666",
+			run:           doNELReport,
+		},
+		{
+			name:         "combined",
+			args:         "[FILE_GLOB...]",
+			summary:      "run the standard, unique and nel subsystems in one process",
+			run:          doCombined,
+			optionalArgs: true,
+			inputs:       true,
+			flags: func(fs *flag.FlagSet, opts *options) {
+				fs.StringVar(&opts.subsystems, "subsystems", "", "comma separated subsystems to run (default: the ones configured)")
+			},
+		},
+		{
+			name:    "replay",
+			args:    "FILE...",
+			summary: "feed log files (or - for stdin) through the config and print the resulting metrics",
+			run:     doReplay,
+			offline: true,
+			flags: func(fs *flag.FlagSet, opts *options) {
+				fs.StringVar(&opts.format, "format", "text", "output format: text (Prometheus exposition) or json")
+				timeFieldFlag(fs, opts)
+				fs.IntVar(&opts.input, "input", -1, "index in the config inputs of the input whose parser and labels to use (default: the input whose path matches each file, or the auto parser)")
+				fs.StringVar(&opts.subsystems, "subsystems", "", "comma separated subsystems to feed: standard, unique (default: the ones configured)")
+			},
+		},
+		{
+			name:    "validate",
+			summary: "check the config and report every problem found",
+			run:     doValidate,
+			offline: true,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: nginxmetrics <command> [flags] [args]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "  %-10s %s\n", "help", "show help for a command")
+	fmt.Fprintf(w, "\nRun 'nginxmetrics <command> --help' for the flags of a command.\n")
+}
+
+func timeFieldFlag(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.timeField, "time-field", "", "field holding the time of each line ($time_iso8601, $time_local, $msec or the error log time; default: the first of "+strings.Join(input.TimeFields, ", ")+")")
+}
+
+func (c *command) flagSet(opts *options, w io.Writer) *flag.FlagSet {
+	var fs = flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.StringVar(&opts.configPath, "config", "", "path of the JSON config file (required)")
+	fs.StringVar(&opts.logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	if !c.offline {
+		var listenDefault = fmt.Sprintf("default %q", c.defaultListen)
+		if len(c.defaultListen) == 0 {
+			listenDefault = "default: one port per subsystem"
+		}
+		fs.StringVar(&opts.listen, "listen", "", fmt.Sprintf("HTTP listen address, overrides http.%s.listen (%s)", c.name, listenDefault))
+		fs.StringVar(&opts.tlsCert, "tls-cert", "", fmt.Sprintf("TLS certificate file, overrides http.%s.tls_cert", c.name))
+		fs.StringVar(&opts.tlsKey, "tls-key", "", fmt.Sprintf("TLS key file, overrides http.%s.tls_key", c.name))
+		fs.BoolVar(&opts.watchConfig, "watch-config", false, "reload the config when the file changes, besides on SIGHUP")
+	}
+	if c.inputs {
+		timeFieldFlag(fs, opts)
+		fs.DurationVar(&opts.fileGrace, "file-grace", time.Minute, "how long a followed file can be gone before it is no longer followed")
+		fs.StringVar(&opts.checkpointFile, "checkpoint-file", "", "file saving the positions in the followed files, to resume from them after a restart")
+		fs.DurationVar(&opts.backfill, "backfill", 0, "on startup, read the rotated files (FILE.1, FILE.2.gz, ...) not yet read, or the lines of the last DURATION when there is no checkpoint")
+		fs.Int64Var(&opts.maxCatchUp, "max-catch-up", 64<<20, "maximum number of bytes read from a file that is behind on startup (0 for no limit)")
+	}
+	if c.flags != nil {
+		c.flags(fs, opts)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(w, "Usage: nginxmetrics %s [flags] %s\n\n%s.\n\nFlags:\n", c.name, c.args, strings.ToUpper(c.summary[:1])+c.summary[1:])
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// legacyArgs rewrites the old "CONFIG MODE [FILES...]" invocation into
+// "MODE --config CONFIG [FILES...]".
+func legacyArgs(args []string) ([]string, bool) {
+	if len(args) < 2 || findCommand(args[0]) != nil || findCommand(args[1]) == nil {
+		return args, false
+	}
+	return append([]string{args[1], "--config", args[0]}, args[2:]...), true
+}
+
+// serverConfig merges the http section of the config for the command with
+// the flags given on the command line.
+func (c *command) serverConfig(config *config, opts *options) (*ServerConfig, error) {
+	var rv ServerConfig
+	if s, ok := config.HTTP[c.name]; ok && s != nil {
+		rv = *s
+	}
+	if len(opts.listen) > 0 {
+		rv.Listen = opts.listen
+	}
+	if len(rv.Listen) == 0 {
+		rv.Listen = c.defaultListen
+	}
+	if len(opts.tlsCert) > 0 {
+		rv.TLSCert = opts.tlsCert
+	}
+	if len(opts.tlsKey) > 0 {
+		rv.TLSKey = opts.tlsKey
+	}
+	return &rv, rv.validate()
+}
+
+func loadConfig(path string) (*config, error) {
+	var config config
+	var configContent, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(configContent, &config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &config, nil
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		printUsage(stderr)
+		return exitUsage
+	}
+	switch args[0] {
+	case "-h", "-help", "--help":
+		printUsage(stdout)
+		return exitOK
+	case "help":
+		if len(args) < 2 {
+			printUsage(stdout)
+			return exitOK
+		}
+		var c = findCommand(args[1])
+		if c == nil {
+			fmt.Fprintf(stderr, "nginxmetrics: unknown command %q\n\n", args[1])
+			printUsage(stderr)
+			return exitUsage
+		}
+		c.flagSet(&options{}, stdout).Usage()
+		return exitOK
+	}
+
+	var legacy bool
+	args, legacy = legacyArgs(args)
+	var c = findCommand(args[0])
+	if c == nil {
+		fmt.Fprintf(stderr, "nginxmetrics: unknown command %q\n\n", args[0])
+		printUsage(stderr)
+		return exitUsage
+	}
+
+	var opts = options{stdin: stdin, stdout: stdout, stderr: stderr}
+	var fs = c.flagSet(&opts, stderr)
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	var usageError = func(format string, a ...interface{}) int {
+		fmt.Fprintf(stderr, "nginxmetrics %s: %s\n\n", c.name, fmt.Sprintf(format, a...))
+		fs.Usage()
+		return exitUsage
+	}
+	if len(opts.configPath) == 0 {
+		return usageError("missing --config")
+	}
+	level, err := logging.ParseLevel(opts.logLevel)
+	if err != nil {
+		return usageError("%v", err)
+	}
+	if len(c.args) == 0 && fs.NArg() > 0 {
+		return usageError("unexpected arguments %v", fs.Args())
+	}
+	logging.SetLevel(level)
+	if legacy {
+		logging.Warnf("the CONFIG MODE [FILES...] invocation is deprecated, use: nginxmetrics %s --config %s", c.name, opts.configPath)
+	}
+
+	config, err := loadConfig(opts.configPath)
+	if err != nil {
+		logging.Errorf("loading config: %v", err)
+		return exitError
+	}
+	if len(c.args) > 0 && !c.optionalArgs && fs.NArg() == 0 && !(c.inputs && len(config.Inputs) > 0) {
+		return usageError("missing %s", c.args)
+	}
+	if !c.offline {
+		if problems := validateConfig(config); len(problems) > 0 {
+			for _, p := range problems {
+				logging.Errorf("invalid config: %v", p)
+			}
+			return exitError
+		}
+		opts.server, err = c.serverConfig(config, &opts)
+		if err != nil {
+			logging.Errorf("http.%s: %v", c.name, err)
+			return exitError
+		}
+		opts.reloader = newReloader(opts.configPath, config)
+		go opts.reloader.watch(opts.watchConfig)
+	}
+	if err := c.run(config, &opts, fs.Args()); err != nil {
+		logging.Errorf("%s: %v", c.name, err)
+		return exitError
+	}
+	return exitOK
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRun_Usage(t *testing.T) {
+	var cases = []struct {
+		args     []string
+		exitCode int
+		output   string
+	}{
+		{[]string{}, exitUsage, "Usage: nginxmetrics <command>"},
+		{[]string{"--help"}, exitOK, "Usage: nginxmetrics <command>"},
+		{[]string{"help", "unique"}, exitOK, "Usage: nginxmetrics unique"},
+		{[]string{"bogus"}, exitUsage, `unknown command "bogus"`},
+		{[]string{"standard", "--help"}, exitOK, "-listen"},
+		{[]string{"standard", "/var/log/nginx/*.log"}, exitUsage, "missing --config"},
+		{[]string{"standard", "--config", "nginx.config.json"}, exitUsage, "missing FILE_GLOB..."},
+		{[]string{"nel", "--config", "nginx.config.json", "extra"}, exitUsage, "unexpected arguments"},
+		{[]string{"nel", "--config", "nginx.config.json", "--log-level", "loud"}, exitUsage, "unknown log level"},
+		{[]string{"nel", "--config", "does-not-exist.json"}, exitError, ""},
+		{[]string{"validate", "--config", "nginx.config.json"}, exitOK, "nginx.config.json: OK"},
+		{[]string{"validate", "--config", "nginx.config.json", "--listen", ":1"}, exitUsage, "-listen"},
+	}
+	for _, c := range cases {
+		var stdout, stderr bytes.Buffer
+		var rc = run(c.args, nil, &stdout, &stderr)
+		if rc != c.exitCode {
+			t.Errorf("%v: exit code = %d, expected %d", c.args, rc, c.exitCode)
+		}
+		if !strings.Contains(stdout.String()+stderr.String(), c.output) {
+			t.Errorf("%v: output does not contain %q:\n%s%s", c.args, c.output, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestLegacyArgs(t *testing.T) {
+	var args, legacy = legacyArgs([]string{"config.json", "unique", "a.log", "b.log"})
+	if !legacy || strings.Join(args, " ") != "unique --config config.json a.log b.log" {
+		t.Errorf("unexpected args: %v", args)
+	}
+	if _, legacy := legacyArgs([]string{"standard", "--config", "config.json"}); legacy {
+		t.Error("standard invocation detected as legacy")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"mxmz.it/nginxmetrics/metrics"
+)
+
+var subsystemNames = []string{"standard", "unique", "nel"}
+
+// firstWins merges the families of several registries, keeping the first
+// one when the same family (e.g. the process collector) is in more of them.
+type firstWins []prometheus.Gatherer
+
+func (gs firstWins) Gather() ([]*dto.MetricFamily, error) {
+	var rv = []*dto.MetricFamily{}
+	var seen = map[string]struct{}{}
+	for _, g := range gs {
+		var families, err = g.Gather()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range families {
+			if _, ok := seen[f.GetName()]; !ok {
+				seen[f.GetName()] = struct{}{}
+				rv = append(rv, f)
+			}
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].GetName() < rv[j].GetName() })
+	return rv, nil
+}
+
+// selectedSubsystems returns the subsystems listed in --subsystems or, when
+// it is empty, the ones with a section in the config.
+func selectedSubsystems(config *config, list string) (map[string]bool, error) {
+	var rv = map[string]bool{}
+	if len(list) == 0 {
+		rv["standard"] = len(config.Metrics) > 0
+		rv["unique"] = len(config.Unique) > 0
+		rv["nel"] = len(config.NEL.Uuid) > 0
+		return rv, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		var known = false
+		for _, n := range subsystemNames {
+			known = known || n == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown subsystem %q, expected one of %s", name, strings.Join(subsystemNames, ", "))
+		}
+		rv[name] = true
+	}
+	return rv, nil
+}
+
+func doCombined(config *config, opts *options, files []string) error {
+	var selected, err = selectedSubsystems(config, opts.subsystems)
+	if err != nil {
+		return err
+	}
+	if !selected["standard"] && !selected["unique"] && !selected["nel"] {
+		return fmt.Errorf("no subsystem to run")
+	}
+	var inputs []*fileInput
+	if selected["standard"] || selected["unique"] {
+		inputs, err = makeInputs(config, files)
+		if err != nil {
+			return err
+		}
+	}
+
+	var handlers = logHandlers{}
+	var gatherers = firstWins{}
+	var m *metrics.Metrics
+	var u *uniqueExporter
+	if selected["standard"] {
+		m, err = metrics.NewMetrics(config.Metrics)
+		if err != nil {
+			return fmt.Errorf("invalid metrics config: %v", err)
+		}
+		handlers = append(handlers, m)
+		gatherers = append(gatherers, m.Gatherer())
+		go purgeEvery(10*time.Second, m.Purge)
+		opts.reloader.onReload(reloadMetrics(m))
+	}
+	if selected["unique"] {
+		u, err = newUniqueExporter(config)
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, u.m)
+		gatherers = append(gatherers, u.m.Gatherer())
+		go purgeEvery(60*time.Second, u.m.Purge)
+		opts.reloader.onReload(reloadUnique(u.m))
+	}
+	var shownConfig = func() interface{} {
+		var c = opts.reloader.config()
+		var rv = map[string]interface{}{}
+		if selected["standard"] {
+			rv["metrics"] = c.Metrics
+		}
+		if selected["unique"] {
+			rv["unique"] = c.Unique
+		}
+		if selected["nel"] {
+			rv["nel"] = c.NEL
+		}
+		return rv
+	}
+	var running *runningInputs
+	if len(handlers) > 0 {
+		running, err = startInputs(inputs, handlers, 10*time.Second, opts)
+		if err != nil {
+			return err
+		}
+		gatherers = append(gatherers, running.metrics)
+	}
+
+	if len(opts.server.Listen) > 0 {
+		// everything on one mux
+		var server = opts.server
+		var mux = http.NewServeMux()
+		var metricsHandler = requireAuth(server.MetricsAuth, promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}))
+		if len(gatherers) > 0 {
+			mux.Handle("/metrics", metricsHandler)
+			mux.Handle("/", metricsHandler)
+		}
+		if u != nil {
+			u.inspectRoutes(mux, server)
+		}
+		if running != nil {
+			inputsRoute(mux, server, running)
+		}
+		if selected["nel"] {
+			nelRoutes(mux, config)
+		}
+		mux.Handle("/config", requireAuth(server.AdminAuth, returnAsJson(shownConfig)))
+		return serve(server, mux)
+	}
+
+	// every subsystem on its own port
+	var errCh = make(chan error, len(subsystemNames))
+	for _, name := range subsystemNames {
+		if !selected[name] {
+			continue
+		}
+		var name = name
+		var server, err = findCommand(name).serverConfig(config, &options{tlsCert: opts.tlsCert, tlsKey: opts.tlsKey})
+		if err != nil {
+			return fmt.Errorf("http.%s: %v", name, err)
+		}
+		var mux = http.NewServeMux()
+		switch name {
+		case "standard":
+			standardRoutes(mux, server, opts.reloader, m, running)
+		case "unique":
+			uniqueRoutes(mux, server, opts.reloader, u, running)
+		case "nel":
+			nelRoutes(mux, config)
+			mux.Handle("/config", requireAuth(server.AdminAuth, returnAsJson(func() interface{} { return opts.reloader.config().NEL })))
+		}
+		go func() {
+			errCh <- fmt.Errorf("%s: %v", name, serve(server, mux))
+		}()
+	}
+	return <-errCh
+}
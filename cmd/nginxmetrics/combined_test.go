@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestFirstWins(t *testing.T) {
+	var r1 = prometheus.NewRegistry()
+	var r2 = prometheus.NewRegistry()
+	r1.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	r2.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	r1.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "b_total", Help: "b"}))
+	r2.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "a_total", Help: "a"}))
+
+	var families, err = firstWins{r1, r2}.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names = map[string]int{}
+	for i, f := range families {
+		names[f.GetName()]++
+		if i > 0 && families[i-1].GetName() > f.GetName() {
+			t.Errorf("families not sorted: %s > %s", families[i-1].GetName(), f.GetName())
+		}
+	}
+	for k, v := range names {
+		if v != 1 {
+			t.Errorf("%s gathered %d times", k, v)
+		}
+	}
+	if names["a_total"] != 1 || names["b_total"] != 1 {
+		t.Errorf("missing families: %v", names)
+	}
+}
+
+func TestSelectedSubsystems(t *testing.T) {
+	var config = &config{NEL: NELConfig{Uuid: "x"}}
+	var selected, _ = selectedSubsystems(config, "")
+	if selected["standard"] || selected["unique"] || !selected["nel"] {
+		t.Errorf("unexpected default subsystems: %v", selected)
+	}
+	selected, _ = selectedSubsystems(config, "standard, unique")
+	if !selected["standard"] || !selected["unique"] || selected["nel"] {
+		t.Errorf("unexpected subsystems: %v", selected)
+	}
+	if _, err := selectedSubsystems(config, "standard,bogus"); err == nil {
+		t.Error("expected error for unknown subsystem")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"mxmz.it/nginxmetrics/input"
+	"mxmz.it/nginxmetrics/logging"
+	"mxmz.it/nginxmetrics/metrics"
+)
+
+// InputConfig is a set of files to follow (or a syslog address to receive
+// lines on) and the way their lines are parsed. Labels and the named groups
+// of PathRegex matched on the path of each file are added as fields to every
+// line of the file. A path of "-" (input.Stdin) reads the standard input, and
+// named pipes are read as streams.
+type InputConfig struct {
+	Path      string            `json:"path,omitempty"`
+	Syslog    string            `json:"syslog,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	PathRegex string            `json:"path_regex,omitempty"`
+	input.ParserConfig
+}
+
+// checkpointInterval is how often the checkpoint file is saved.
+var checkpointInterval = 10 * time.Second
+
+type fileInput struct {
+	config *InputConfig
+	parse  input.Parser
+	pathRe *regexp.Regexp
+}
+
+func newFileInput(c *InputConfig, logFormat string) (*fileInput, error) {
+	var pc = c.ParserConfig
+	if len(pc.LogFormat) == 0 {
+		pc.LogFormat = logFormat
+	}
+	var parse, err = input.NewParser(pc)
+	if err != nil {
+		return nil, err
+	}
+	var in = &fileInput{config: c, parse: parse}
+	if len(c.PathRegex) > 0 {
+		in.pathRe, err = regexp.Compile(c.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("path_regex: %v", err)
+		}
+	}
+	return in, nil
+}
+
+// parserFor returns the parser of the lines of path, which adds the labels
+// of the input.
+func (in *fileInput) parserFor(path string) input.Parser {
+	var labels = map[string]string{}
+	for k, v := range in.config.Labels {
+		labels[k] = v
+	}
+	if in.pathRe != nil {
+		if m := in.pathRe.FindStringSubmatch(path); m != nil {
+			for i, name := range in.pathRe.SubexpNames() {
+				if len(name) > 0 {
+					labels[name] = m[i]
+				}
+			}
+		}
+	}
+	if len(labels) == 0 {
+		return in.parse
+	}
+	return input.ParserFunc(func(text string) (map[string]string, error) {
+		var l, err = in.parse.Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range labels {
+			l[k] = v
+		}
+		return l, nil
+	})
+}
+
+// makeInputs returns the inputs of the config followed by the globs given on
+// the command line, which are read with the auto parser.
+func makeInputs(c *config, globs []string) ([]*fileInput, error) {
+	var configs = append([]*InputConfig{}, c.Inputs...)
+	for _, glob := range globs {
+		configs = append(configs, &InputConfig{Path: glob})
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("missing FILE_GLOB... or inputs")
+	}
+	var rv = make([]*fileInput, 0, len(configs))
+	for _, ic := range configs {
+		var in, err = newFileInput(ic, c.LogFormat)
+		if err != nil {
+			return nil, fmt.Errorf("%s%s: %v", ic.Path, ic.Syslog, err)
+		}
+		rv = append(rv, in)
+	}
+	return rv, nil
+}
+
+// runningInputs are the followed files and the counters of the syslog
+// inputs.
+type runningInputs struct {
+	files   *input.Manager
+	metrics *prometheus.Registry
+}
+
+// startInputs follows the files matching the inputs, looking for new files
+// on inotify events and every rescan, and starts the syslog inputs. A file
+// matching several inputs is read by the first one. With a checkpoint file,
+// the positions in the files are saved periodically and when the process is
+// terminated. With a backfill window, the rotated files are read on startup.
+func startInputs(inputs []*fileInput, m logHandler, rescan time.Duration, opts *options) (*runningInputs, error) {
+	var running = &runningInputs{metrics: prometheus.NewRegistry()}
+	var sources = make([]input.Source, 0, len(inputs))
+	for _, in := range inputs {
+		if len(in.config.Syslog) > 0 {
+			var s, err = input.ListenSyslog(in.config.Syslog, in.parserFor(""), m, running.metrics)
+			if err != nil {
+				return nil, fmt.Errorf("syslog %s: %v", in.config.Syslog, err)
+			}
+			go s.Run()
+			continue
+		}
+		sources = append(sources, input.Source{Glob: in.config.Path, Parser: in.parserFor})
+	}
+	running.files = input.NewManager(sources, m, rescan, opts.fileGrace)
+	running.files.Backfill(opts.backfill, opts.timeField)
+	if len(opts.checkpointFile) == 0 {
+		go running.files.Run(nil)
+		return running, nil
+	}
+	var checkpoints, err = input.LoadCheckpoints(opts.checkpointFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading checkpoints: %v", err)
+	}
+	running.files.Resume(checkpoints, checkpointInterval, opts.maxCatchUp)
+	var stop = make(chan struct{})
+	var done = make(chan struct{})
+	go func() {
+		running.files.Run(stop)
+		close(done)
+	}()
+	go func() {
+		var sig = make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		logging.Infof("%v received, saving checkpoints", <-sig)
+		close(stop)
+		<-done
+		os.Exit(exitOK)
+	}()
+	return running, nil
+}
+
+func validateInputs(c *config) metrics.ValidationErrors {
+	var rv = metrics.ValidationErrors{}
+	if len(c.LogFormat) > 0 {
+		if _, err := input.NewTextFormat(c.LogFormat); err != nil {
+			rv = append(rv, metrics.ValidationError{Path: "log_format", Message: err.Error()})
+		}
+	}
+	for i, ic := range c.Inputs {
+		var p = fmt.Sprintf("inputs[%d]", i)
+		if ic == nil {
+			rv = append(rv, metrics.ValidationError{Path: p, Message: "empty input"})
+			continue
+		}
+		if (len(ic.Path) == 0) == (len(ic.Syslog) == 0) {
+			rv = append(rv, metrics.ValidationError{Path: p, Message: "one of path and syslog is required"})
+		}
+		if len(ic.Syslog) > 0 {
+			if _, _, err := input.SplitSyslogAddress(ic.Syslog); err != nil {
+				rv = append(rv, metrics.ValidationError{Path: metrics.JoinPath(p, "syslog"), Message: err.Error()})
+			}
+			if len(ic.PathRegex) > 0 {
+				rv = append(rv, metrics.ValidationError{Path: metrics.JoinPath(p, "path_regex"), Message: "not supported by syslog inputs"})
+			}
+		}
+		if _, err := newFileInput(ic, c.LogFormat); err != nil {
+			rv = append(rv, metrics.ValidationError{Path: p, Message: err.Error()})
+		}
+	}
+	return rv
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"mxmz.it/nginxmetrics/input"
+)
+
+func TestFileInput_ParserFor(t *testing.T) {
+	var in, err = newFileInput(&InputConfig{
+		Path:         "/var/log/nginx/*/access.log",
+		ParserConfig: input.ParserConfig{Parser: "text"},
+		Labels:       map[string]string{"env": "prod", "site": "default"},
+		PathRegex:    `/var/log/nginx/(?P<site>[^/]+)/access\.log`,
+	}, "combined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parse = in.parserFor("/var/log/nginx/shop/access.log")
+	l, err := parse.Parse(`10.0.0.1 - - [01/Jun/2021:10:00:00 +0200] "GET / HTTP/1.1" 200 612 "-" "curl/7.68.0"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l["site"] != "shop" || l["env"] != "prod" || l["status"] != "200" {
+		t.Errorf("unexpected fields: %v", l)
+	}
+	if _, err := parse.Parse(`{"status": 200}`); err == nil {
+		t.Error("JSON line accepted by the text parser")
+	}
+	l, _ = in.parserFor("/srv/other.log").Parse(`10.0.0.1 - - [01/Jun/2021:10:00:00 +0200] "GET / HTTP/1.1" 200 612 "-" "curl/7.68.0"`)
+	if l["site"] != "default" {
+		t.Errorf("site = %q, expected the static label", l["site"])
+	}
+}
+
+func TestValidateInputs(t *testing.T) {
+	var c config
+	var err = json.Unmarshal([]byte(`{
+		"inputs": [
+			{ "path": "/var/log/nginx/access.log", "parser": "json" },
+			{ "parser": "text" },
+			{ "path": "/var/log/nginx/error.log", "parser": "syslog" },
+			{ "path": "/var/log/nginx/*/access.log", "path_regex": "(?P<site" },
+			{ "syslog": "tcp://:514", "parser": "json" },
+			{ "path": "/var/log/nginx/access.log", "syslog": "udp://:514" },
+			{ "syslog": "unix:///run/nginxmetrics.sock", "path_regex": "x" }
+		]
+	}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{"inputs[1]", "inputs[1]", "inputs[2]", "inputs[3]", "inputs[4].syslog", "inputs[5]", "inputs[6].path_regex"}
+	var problems = validateInputs(&c)
+	if len(problems) != len(expected) {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	for i, p := range problems {
+		if p.Path != expected[i] {
+			t.Errorf("problem %d: path = %s, expected %s", i, p.Path, expected[i])
+		}
+	}
+}
@@ -1,22 +1,17 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
-	"strings"
 	"sync/atomic"
 
-	"github.com/hpcloud/tail"
-
 	"encoding/json"
 	"net/http"
-	"path/filepath"
 	"time"
 
-	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"mxmz.it/nginxmetrics/logging"
 	"mxmz.it/nginxmetrics/metrics"
 )
 
@@ -30,174 +25,153 @@ type config struct {
 	Metrics map[string]*metrics.MetricConfig          `json:"metrics,omitempty"`
 	Unique  map[string]*metrics.DistinctCounterConfig `json:"unique,omitempty"`
 	NEL     NELConfig                                 `json:"nel,omitempty"`
+	HTTP    map[string]*ServerConfig                  `json:"http,omitempty"`
+	// LogFormat is the nginx log_format (or one of input.Presets) of the
+	// access log lines that are not JSON.
+	LogFormat string         `json:"log_format,omitempty"`
+	Inputs    []*InputConfig `json:"inputs,omitempty"`
 }
 
 type logHandler interface {
 	HandleLogLine(line map[string]string)
 }
 
+// logHandlers fans every line out to all the handlers, so that files are
+// read and parsed once when several subsystems run in the same process.
+type logHandlers []logHandler
+
+func (hs logHandlers) HandleLogLine(line map[string]string) {
+	for _, h := range hs {
+		h.HandleLogLine(line)
+	}
+}
+
 func main() {
-	var config config
-	var configContent, err = ioutil.ReadFile(os.Args[1])
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func purgeEvery(interval time.Duration, purge func(time.Time)) {
+	for {
+		time.Sleep(interval)
+		purge(time.Now())
+	}
+}
+
+func inputsRoute(mux *http.ServeMux, server *ServerConfig, in *runningInputs) {
+	mux.Handle("/inputs", requireAuth(server.AdminAuth, returnAsJson(func() interface{} { return in.files.Files() })))
+}
+
+func standardRoutes(mux *http.ServeMux, server *ServerConfig, r *reloader, m *metrics.Metrics, in *runningInputs) {
+	var metricsHandler = requireAuth(server.MetricsAuth, promhttp.HandlerFor(firstWins{m.Gatherer(), in.metrics}, promhttp.HandlerOpts{}))
+	mux.Handle("/metrics", metricsHandler)
+	mux.Handle("/config", requireAuth(server.AdminAuth, returnAsJson(func() interface{} { return r.config().Metrics })))
+	inputsRoute(mux, server, in)
+	mux.Handle("/", metricsHandler)
+}
+
+func doStandardMetrics(config *config, opts *options, files []string) error {
+	var inputs, err = makeInputs(config, files)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	err = json.Unmarshal(configContent, &config)
+	m, err := metrics.NewMetrics(config.Metrics)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("invalid metrics config: %v", err)
 	}
 
-	var mode = os.Args[2]
-	switch mode {
-	case "standard":
-		{
-			doStandardMetrics(&config, os.Args[3:])
-		}
-
-	case "unique":
-		{
-			doUniqueMetrics(&config, os.Args[3:])
-		}
-	case "nel":
-		{
-			doNELReport(&config)
-		}
+	running, err := startInputs(inputs, m, 10*time.Second, opts)
+	if err != nil {
+		return err
 	}
+	go purgeEvery(10*time.Second, m.Purge)
+	opts.reloader.onReload(reloadMetrics(m))
 
+	var mux = http.NewServeMux()
+	standardRoutes(mux, opts.server, opts.reloader, m, running)
+	return serve(opts.server, mux)
 }
 
-func doStandardMetrics(config *config, files []string) {
-	var m = metrics.NewMetrics(config.Metrics)
-
-	go func() {
-		var found = map[string]struct{}{}
-		for {
-			fmt.Println(len(found))
-			for _, v := range files {
-
-				var files, _ = filepath.Glob(v)
-				for _, v := range files {
-					if _, ok := found[v]; !ok {
-						go followLog(m, v)
-						found[v] = struct{}{}
-					}
-				}
-			}
-			time.Sleep(10 * time.Second)
-		}
-
-	}()
-	http.Handle("/metrics", m.HttpHandler())
-	http.Handle("/config", returnAsJson((config.Metrics)))
-	http.Handle("/", m.HttpHandler())
-	http.ListenAndServe(":9802", nil)
+type uniqueExporter struct {
+	m        *metrics.UniqueValueMetrics
+	warnings int64
+	warnCh   chan int64
 }
-func doUniqueMetrics(config *config, files []string) {
-	var warnings int64 = 0
-	var warnCh = make(chan int64)
 
-	var m = metrics.NewUniqueValueMetrics(config.Unique, func(name string, k string, labels map[string]string, rate float64) {
-		v := atomic.AddInt64(&warnings, 1)
+func newUniqueExporter(config *config) (*uniqueExporter, error) {
+	var u = &uniqueExporter{warnCh: make(chan int64)}
+	var err error
+	u.m, err = metrics.NewUniqueValueMetrics(config.Unique, func(name string, k string, labels map[string]string, rate float64) {
+		v := atomic.AddInt64(&u.warnings, 1)
 		select {
-		case warnCh <- v:
+		case u.warnCh <- v:
 		default:
-			log.Printf("WARN: %s: id = %s labels = [%v] rate = %v", name, k, labels, rate)
+			logging.Warnf("%s: id = %s labels = [%v] rate = %v", name, k, labels, rate)
 		}
 
 	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid unique config: %v", err)
+	}
+	return u, nil
+}
 
-	go func() {
-		var found = map[string]struct{}{}
-		for {
-			fmt.Println(len(found))
-			for _, v := range files {
-
-				var files, _ = filepath.Glob(v)
-				for _, v := range files {
-					if _, ok := found[v]; !ok {
-						go followLog(m, v)
-						found[v] = struct{}{}
-					}
-				}
-			}
-			time.Sleep(60 * time.Second)
-			m.Purge(time.Now())
-		}
-
-	}()
-	http.Handle("/metrics", m.HttpHandler())
-	http.Handle("/", m.HttpHandler())
-
-	var inspect = m.InspectHttpHandler()
-	http.Handle("/inspect", inspect)
-	http.Handle("/config", returnAsJson((config.Unique)))
-	http.HandleFunc("/inspect/wait", func(rsp http.ResponseWriter, r *http.Request) {
+func (u *uniqueExporter) inspectRoutes(mux *http.ServeMux, server *ServerConfig) {
+	var inspect = u.m.InspectHttpHandler()
+	mux.Handle("/inspect", requireAuth(server.AdminAuth, inspect))
+	mux.Handle("/inspect/wait", requireAuth(server.AdminAuth, http.HandlerFunc(func(rsp http.ResponseWriter, r *http.Request) {
 
 		select {
-		case <-warnCh:
+		case <-u.warnCh:
 		case <-r.Context().Done():
 			{
-				log.Println("abort /inspect/wait")
+				logging.Debugf("abort /inspect/wait")
 			}
 		case <-time.After(30 * time.Second):
 		}
-		rsp.Header().Add("X-Warnings", fmt.Sprintf("%d", warnings))
+		rsp.Header().Add("X-Warnings", fmt.Sprintf("%d", atomic.LoadInt64(&u.warnings)))
 		inspect.ServeHTTP(rsp, r)
 
-	})
-
-	http.ListenAndServe(":9803", nil)
+	})))
 }
 
-func returnAsJson(rv interface{}) http.Handler {
-	return http.HandlerFunc(func(rsp http.ResponseWriter, _ *http.Request) {
-		var json, _ = json.Marshal(rv)
-		rsp.Header().Add("Content-Type", "application/json")
-		rsp.WriteHeader(200)
-		rsp.Write(json)
-	})
+func uniqueRoutes(mux *http.ServeMux, server *ServerConfig, r *reloader, u *uniqueExporter, in *runningInputs) {
+	var metricsHandler = requireAuth(server.MetricsAuth, promhttp.HandlerFor(firstWins{u.m.Gatherer(), in.metrics}, promhttp.HandlerOpts{}))
+	mux.Handle("/metrics", metricsHandler)
+	mux.Handle("/", metricsHandler)
+	mux.Handle("/config", requireAuth(server.AdminAuth, returnAsJson(func() interface{} { return r.config().Unique })))
+	u.inspectRoutes(mux, server)
+	inputsRoute(mux, server, in)
 }
 
-func followLog(m logHandler, path string) {
+func doUniqueMetrics(config *config, opts *options, files []string) error {
+	var inputs, err = makeInputs(config, files)
+	if err != nil {
+		return err
+	}
+	u, err := newUniqueExporter(config)
+	if err != nil {
+		return err
+	}
 
-	t, err := tail.TailFile(path, tail.Config{Follow: true, ReOpen: true, Location: &tail.SeekInfo{Offset: 0, Whence: os.SEEK_END}, Poll: true})
+	running, err := startInputs(inputs, u.m, 60*time.Second, opts)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	var json = jsoniter.ConfigCompatibleWithStandardLibrary
-	var lines = t.Lines
-	var count = 0
-	for {
-		select {
-		case line := <-lines:
-			{
-				var err error
-				var lineMap map[string]interface{}
-				if strings.HasPrefix(line.Text, "{") {
-					err = json.Unmarshal([]byte(line.Text), &lineMap)
-				} else {
-					if strings.Contains(line.Text, "[error]") {
-						lineMap = map[string]interface{}{
-							"error": "1",
-						}
-					} else if strings.Contains(line.Text, "[crit]") {
-						lineMap = map[string]interface{}{
-							"crit": "1",
-						}
-					} else {
-						err = errors.New("SKIPPING LINE")
-					}
-				}
+	go purgeEvery(60*time.Second, u.m.Purge)
+	opts.reloader.onReload(reloadUnique(u.m))
 
-				if err == nil {
-					m.HandleLogLine(metrics.StringizeMap(lineMap))
-					count++
-					//println(count, line.Text)
-				}
+	var mux = http.NewServeMux()
+	uniqueRoutes(mux, opts.server, opts.reloader, u, running)
+	return serve(opts.server, mux)
+}
 
-			}
-		}
-	}
+func returnAsJson(get func() interface{}) http.Handler {
+	return http.HandlerFunc(func(rsp http.ResponseWriter, _ *http.Request) {
+		var json, _ = json.Marshal(get())
+		rsp.Header().Add("Content-Type", "application/json")
+		rsp.WriteHeader(200)
+		rsp.Write(json)
+	})
 }
 
 func fileIsEmpty(path string) bool {
@@ -243,7 +217,10 @@ func sendReportToChan(typ string, ch chan<- interface{}) http.Handler {
 		rsp.Write([]byte("ok\n"))
 	})
 }
-func doNELReport(config *config) {
+
+// nelRoutes starts the writers of the report logs and registers the
+// report endpoints, which are always open to browsers.
+func nelRoutes(mux *http.ServeMux, config *config) {
 	var nelLog = config.NEL.NELReportLog
 	var cspLog = config.NEL.CSPReportLog
 	var nelLogCh = make(chan interface{})
@@ -275,15 +252,20 @@ func doNELReport(config *config) {
 	go logger(nelLogCh, nelLog)
 	go logger(cspLogCh, cspLog)
 
-	http.Handle("/nel/"+config.NEL.Uuid, sendReportToChan("nel", nelLogCh))
-	http.Handle("/csp/"+config.NEL.Uuid, sendReportToChan("csp", cspLogCh))
+	mux.Handle("/nel/"+config.NEL.Uuid, sendReportToChan("nel", nelLogCh))
+	mux.Handle("/csp/"+config.NEL.Uuid, sendReportToChan("csp", cspLogCh))
 
 	var nop = func(rsp http.ResponseWriter, _ *http.Request) {
 		rsp.Header().Add("Content-Type", "text/plain")
 		rsp.WriteHeader(200)
 		rsp.Write([]byte("nop\n"))
 	}
-	http.HandleFunc("/nop", nop)
-	http.Handle("/config", returnAsJson(config.NEL))
-	http.ListenAndServe(":10666", nil)
+	mux.HandleFunc("/nop", nop)
+}
+
+func doNELReport(config *config, opts *options, _ []string) error {
+	var mux = http.NewServeMux()
+	nelRoutes(mux, config)
+	mux.Handle("/config", requireAuth(opts.server.AdminAuth, returnAsJson(func() interface{} { return opts.reloader.config().NEL })))
+	return serve(opts.server, mux)
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+	"mxmz.it/nginxmetrics/logging"
+	"mxmz.it/nginxmetrics/metrics"
+)
+
+type prepareFunc func(c *config) (commit func(), err error)
+
+// reloader re-reads the config file on SIGHUP or, optionally, when the file
+// changes. The new config is applied only if every subsystem accepts it.
+type reloader struct {
+	path    string
+	current *config
+	prepare []prepareFunc
+	lock    sync.RWMutex
+}
+
+func newReloader(path string, c *config) *reloader {
+	return &reloader{path: path, current: c}
+}
+
+func (r *reloader) config() *config {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.current
+}
+
+func (r *reloader) onReload(p prepareFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.prepare = append(r.prepare, p)
+}
+
+func (r *reloader) reload() error {
+	var c, err = loadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	if problems := validateConfig(c); len(problems) > 0 {
+		return problems
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var commits = make([]func(), 0, len(r.prepare))
+	for _, p := range r.prepare {
+		commit, err := p(c)
+		if err != nil {
+			return err
+		}
+		commits = append(commits, commit)
+	}
+	if !reflect.DeepEqual(r.current.HTTP, c.HTTP) {
+		logging.Warnf("changes to the http section take effect on restart")
+	}
+	if !reflect.DeepEqual(r.current.NEL, c.NEL) {
+		logging.Warnf("changes to the nel section take effect on restart")
+	}
+	if r.current.LogFormat != c.LogFormat || !reflect.DeepEqual(r.current.Inputs, c.Inputs) {
+		logging.Warnf("changes to log_format and inputs take effect on restart")
+	}
+	for _, commit := range commits {
+		commit()
+	}
+	r.current = c
+	return nil
+}
+
+func reloadMetrics(m *metrics.Metrics) prepareFunc {
+	return func(c *config) (func(), error) { return m.PrepareReload(c.Metrics) }
+}
+
+func reloadUnique(m *metrics.UniqueValueMetrics) prepareFunc {
+	return func(c *config) (func(), error) { return m.PrepareReload(c.Unique) }
+}
+
+// watch reloads the config on SIGHUP and, when watchFile is set, on changes
+// of the config file.
+func (r *reloader) watch(watchFile bool) {
+	var hup = make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var changed <-chan struct{}
+	if watchFile {
+		var err error
+		changed, err = watchConfigFile(r.path)
+		if err != nil {
+			logging.Errorf("watching %s: %v", r.path, err)
+		}
+	}
+	for {
+		select {
+		case <-hup:
+			logging.Infof("SIGHUP received, reloading %s", r.path)
+		case <-changed:
+			logging.Infof("%s changed, reloading", r.path)
+		}
+		if err := r.reload(); err != nil {
+			logging.Errorf("config reload rejected: %v", err)
+		} else {
+			logging.Infof("config reloaded")
+		}
+	}
+}
+
+// watchConfigFile notifies the changes of path. The directory is watched
+// rather than the file, so that editors replacing the file are handled, and
+// bursts of events are coalesced.
+func watchConfigFile(path string) (<-chan struct{}, error) {
+	var watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	var target = filepath.Clean(path)
+	var ch = make(chan struct{}, 1)
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != target || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(500*time.Millisecond, func() {
+					select {
+					case ch <- struct{}{}:
+					default:
+					}
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logging.Errorf("watching %s: %v", path, err)
+			}
+		}
+	}()
+	return ch, nil
+}
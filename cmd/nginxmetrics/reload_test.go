@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mxmz.it/nginxmetrics/metrics"
+)
+
+func TestReloader(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "nginxmetrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "config.json")
+	var write = func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"metrics": {"requests_total": {"type": "count"}}}`)
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := metrics.NewMetrics(config.Metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r = newReloader(path, config)
+	r.onReload(reloadMetrics(m))
+
+	write(`{"metrics": {"requests_total": {"type": "bogus"}}}`)
+	if err := r.reload(); err == nil {
+		t.Error("expected invalid config to be rejected")
+	}
+	if r.config() != config {
+		t.Error("config replaced by a rejected one")
+	}
+
+	write(`{"metrics": {"requests_total": {"type": "count"}, "errors_total": {"type": "count"}}}`)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.config().Metrics["errors_total"]; !ok {
+		t.Error("config not replaced")
+	}
+}
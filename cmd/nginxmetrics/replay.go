@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"mxmz.it/nginxmetrics/input"
+	"mxmz.it/nginxmetrics/logging"
+	"mxmz.it/nginxmetrics/metrics"
+)
+
+type timedLogHandler interface {
+	HandleLogLineAt(line map[string]string, t time.Time) bool
+}
+
+type replayStats struct {
+	Lines    int `json:"lines"`
+	Parsed   int `json:"parsed"`
+	Skipped  int `json:"skipped"`
+	Filtered int `json:"filtered"`
+}
+
+// eventTime returns the time a line was logged, or fallback when it has
+// none.
+func eventTime(l map[string]string, field string, fallback time.Time) time.Time {
+	if t, ok := input.EventTime(l, field); ok {
+		return t
+	}
+	if fallback.IsZero() {
+		return time.Now()
+	}
+	return fallback
+}
+
+// processFamilies returns the names of the families exported by the
+// process collector, which are left out of the replay output.
+func processFamilies() map[string]struct{} {
+	var r = prometheus.NewRegistry()
+	r.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	var families, _ = r.Gather()
+	var rv = map[string]struct{}{}
+	for _, f := range families {
+		rv[f.GetName()] = struct{}{}
+	}
+	return rv
+}
+
+type jsonMetric struct {
+	Labels    map[string]string  `json:"labels,omitempty"`
+	Value     *float64           `json:"value,omitempty"`
+	Count     *uint64            `json:"count,omitempty"`
+	Sum       *float64           `json:"sum,omitempty"`
+	Quantiles map[string]float64 `json:"quantiles,omitempty"`
+	Buckets   map[string]uint64  `json:"buckets,omitempty"`
+}
+
+type jsonFamily struct {
+	Name    string       `json:"name"`
+	Type    string       `json:"type"`
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func familiesToJson(families []*dto.MetricFamily) []jsonFamily {
+	var rv = make([]jsonFamily, 0, len(families))
+	for _, f := range families {
+		var jf = jsonFamily{Name: f.GetName(), Type: strings.ToLower(f.GetType().String())}
+		for _, m := range f.GetMetric() {
+			var jm = jsonMetric{Labels: map[string]string{}}
+			for _, l := range m.GetLabel() {
+				jm.Labels[l.GetName()] = l.GetValue()
+			}
+			switch {
+			case m.Counter != nil:
+				jm.Value = m.Counter.Value
+			case m.Gauge != nil:
+				jm.Value = m.Gauge.Value
+			case m.Summary != nil:
+				jm.Count, jm.Sum = m.Summary.SampleCount, m.Summary.SampleSum
+				jm.Quantiles = map[string]float64{}
+				for _, q := range m.Summary.GetQuantile() {
+					jm.Quantiles[formatFloat(q.GetQuantile())] = q.GetValue()
+				}
+			case m.Histogram != nil:
+				jm.Count, jm.Sum = m.Histogram.SampleCount, m.Histogram.SampleSum
+				jm.Buckets = map[string]uint64{}
+				for _, b := range m.Histogram.GetBucket() {
+					jm.Buckets[formatFloat(b.GetUpperBound())] = b.GetCumulativeCount()
+				}
+			}
+			jf.Metrics = append(jf.Metrics, jm)
+		}
+		rv = append(rv, jf)
+	}
+	return rv
+}
+
+func replayFile(path string, stdin io.Reader, parse input.Parser, handlers []timedLogHandler, purge func(time.Time), timeField string, stats *replayStats) error {
+	var in = stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var scanner = bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var last, lastPurge time.Time
+	for scanner.Scan() {
+		stats.Lines++
+		var lineMap, err = parse.Parse(scanner.Text())
+		if err != nil {
+			stats.Skipped++
+			continue
+		}
+		stats.Parsed++
+		var t = eventTime(lineMap, timeField, last)
+		last = t
+		var used = false
+		for _, h := range handlers {
+			used = h.HandleLogLineAt(lineMap, t) || used
+		}
+		if !used {
+			stats.Filtered++
+		}
+		if lastPurge.IsZero() {
+			lastPurge = t
+		} else if t.Sub(lastPurge) >= time.Minute {
+			purge(t)
+			lastPurge = t
+		}
+	}
+	if !last.IsZero() {
+		purge(last)
+	}
+	return scanner.Err()
+}
+
+// replayInput returns inputs[index] or, when index is negative, the first
+// file input whose path matches path, as when the file is followed. The
+// other files are read with auto.
+func replayInput(inputs []*fileInput, index int, path string, auto *fileInput) *fileInput {
+	if index >= 0 {
+		return inputs[index]
+	}
+	for _, in := range inputs {
+		if len(in.config.Syslog) > 0 {
+			continue
+		}
+		if ok, _ := filepath.Match(in.config.Path, path); ok {
+			return in
+		}
+	}
+	return auto
+}
+
+func doReplay(config *config, opts *options, files []string) error {
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("unsupported format %q, expected text or json", opts.format)
+	}
+	var selected, err = selectedSubsystems(config, opts.subsystems)
+	if err != nil {
+		return err
+	}
+	if problems := validateConfig(config); len(problems) > 0 {
+		return fmt.Errorf("invalid config: %v", problems)
+	}
+	var inputs = make([]*fileInput, len(config.Inputs))
+	for i, ic := range config.Inputs {
+		if inputs[i], err = newFileInput(ic, config.LogFormat); err != nil {
+			return fmt.Errorf("inputs[%d]: %v", i, err)
+		}
+	}
+	if opts.input >= len(inputs) {
+		return fmt.Errorf("no inputs[%d] in the config", opts.input)
+	}
+	auto, err := newFileInput(&InputConfig{}, config.LogFormat)
+	if err != nil {
+		return err
+	}
+
+	var handlers = []timedLogHandler{}
+	var purgers = []func(time.Time){}
+	var gatherers = firstWins{}
+	if selected["standard"] {
+		m, err := metrics.NewMetrics(config.Metrics)
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, m)
+		purgers = append(purgers, m.Purge)
+		gatherers = append(gatherers, m.Gatherer())
+	}
+	if selected["unique"] {
+		u, err := metrics.NewUniqueValueMetrics(config.Unique, func(name string, k string, labels map[string]string, rate float64) {
+			logging.Debugf("%s: id = %s labels = [%v] rate = %v", name, k, labels, rate)
+		})
+		if err != nil {
+			return err
+		}
+		handlers = append(handlers, u)
+		purgers = append(purgers, u.Purge)
+		gatherers = append(gatherers, u.Gatherer())
+	}
+	if len(handlers) == 0 {
+		return fmt.Errorf("no metrics to replay")
+	}
+	var purge = func(t time.Time) {
+		for _, p := range purgers {
+			p(t)
+		}
+	}
+
+	var stats replayStats
+	for _, path := range files {
+		var parse = replayInput(inputs, opts.input, path, auto).parserFor(path)
+		if err := replayFile(path, opts.stdin, parse, handlers, purge, opts.timeField, &stats); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	families, err := gatherers.Gather()
+	if err != nil {
+		return err
+	}
+	var skip = processFamilies()
+	var out = make([]*dto.MetricFamily, 0, len(families))
+	for _, f := range families {
+		if _, ok := skip[f.GetName()]; !ok {
+			out = append(out, f)
+		}
+	}
+
+	if opts.format == "json" {
+		var enc = json.NewEncoder(opts.stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(map[string]interface{}{"metrics": familiesToJson(out), "summary": stats}); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range out {
+			if _, err := expfmt.MetricFamilyToText(opts.stdout, f); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Fprintf(opts.stderr, "lines: %d parsed: %d skipped: %d filtered: %d\n", stats.Lines, stats.Parsed, stats.Skipped, stats.Filtered)
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventTime(t *testing.T) {
+	var fallback = time.Unix(1000, 0)
+	var cases = []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2021-06-01T10:00:00+02:00", time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{"01/Jun/2021:10:00:00 +0200", time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC)},
+		{"1622534400.500", time.Unix(1622534400, 500000000)},
+		{"", fallback},
+		{"yesterday", fallback},
+	}
+	for _, c := range cases {
+		var got = eventTime(map[string]string{"@timestamp": c.value}, "@timestamp", fallback)
+		if !got.Equal(c.expected) {
+			t.Errorf("%q: got %v, expected %v", c.value, got, c.expected)
+		}
+	}
+}
+
+func TestRun_Replay(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var configPath = filepath.Join(dir, "config.json")
+	ioutil.WriteFile(configPath, []byte(`{
+		"metrics": {
+			"nginx_requests_total": { "type": "count", "label_map": { "status": "status" }, "if_match": { "vhost": "^www" } }
+		},
+		"unique": {
+			"nginx_unique_clients": { "value_source": "remote_addr", "time_window": 60 }
+		}
+	}`), 0644)
+	var log = strings.Join([]string{
+		`{"@timestamp":"2021-06-01T10:00:00+00:00","vhost":"www.example.com","status":200,"remote_addr":"10.0.0.1"}`,
+		`{"@timestamp":"2021-06-01T10:00:01+00:00","vhost":"www.example.com","status":404,"remote_addr":"10.0.0.2"}`,
+		`{"@timestamp":"2021-06-01T10:00:02+00:00","vhost":"api.example.com","status":200,"remote_addr":"10.0.0.1"}`,
+		`not a log line`,
+		`{"@timestamp":"2021-06-01T10:05:00+00:00","vhost":"www.example.com","status":200,"remote_addr":"10.0.0.3"}`,
+	}, "\n")
+
+	var stdout, stderr bytes.Buffer
+	var rc = run([]string{"replay", "--config", configPath, "-"}, strings.NewReader(log), &stdout, &stderr)
+	if rc != exitOK {
+		t.Fatalf("exit code = %d:\n%s", rc, stderr.String())
+	}
+	for _, expected := range []string{
+		`nginx_requests_total{status="200"} 2`,
+		`nginx_requests_total{status="404"} 1`,
+		// the first two clients are out of the time window of the last line
+		`nginx_unique_clients 1`,
+	} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Errorf("output does not contain %q:\n%s", expected, stdout.String())
+		}
+	}
+	if strings.Contains(stdout.String(), "process_") {
+		t.Errorf("output contains process metrics:\n%s", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "lines: 5 parsed: 4 skipped: 1 filtered: 0") {
+		t.Errorf("unexpected summary: %s", stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	rc = run([]string{"replay", "--config", configPath, "--format", "json", "--subsystems", "standard", "-"}, strings.NewReader(log), &stdout, &stderr)
+	if rc != exitOK {
+		t.Fatalf("exit code = %d:\n%s", rc, stderr.String())
+	}
+	var out struct {
+		Metrics []jsonFamily
+		Summary replayStats
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		t.Fatalf("%v:\n%s", err, stdout.String())
+	}
+	if out.Summary.Filtered != 1 {
+		t.Errorf("filtered = %d, expected 1", out.Summary.Filtered)
+	}
+	var found = false
+	for _, f := range out.Metrics {
+		found = found || (f.Name == "nginx_requests_total" && f.Type == "counter" && len(f.Metrics) == 2)
+	}
+	if !found {
+		t.Errorf("nginx_requests_total missing:\n%s", stdout.String())
+	}
+}
+
+func TestRun_ReplayInputs(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var configPath = filepath.Join(dir, "config.json")
+	ioutil.WriteFile(configPath, []byte(`{
+		"metrics": {
+			"nginx_requests_total": { "type": "count", "label_map": { "site": "site", "status": "status" } }
+		},
+		"inputs": [
+			{ "path": "`+dir+`/*/access.log", "parser": "logfmt", "path_regex": "/(?P<site>[^/]+)/access.log$" },
+			{ "path": "/var/log/nginx/access.log", "parser": "text", "log_format": "$status $request_time", "labels": { "site": "main" } }
+		]
+	}`), 0644)
+	os.Mkdir(filepath.Join(dir, "shop"), 0755)
+	var path = filepath.Join(dir, "shop", "access.log")
+	ioutil.WriteFile(path, []byte("status=200\nstatus=500\n"), 0644)
+
+	var stdout, stderr bytes.Buffer
+	var rc = run([]string{"replay", "--config", configPath, path}, nil, &stdout, &stderr)
+	if rc != exitOK {
+		t.Fatalf("exit code = %d:\n%s", rc, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), `nginx_requests_total{site="shop",status="500"} 1`) {
+		t.Errorf("unexpected output:\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	rc = run([]string{"replay", "--config", configPath, "--input", "1", "-"}, strings.NewReader("404 0.010\n"), &stdout, &stderr)
+	if rc != exitOK {
+		t.Fatalf("exit code = %d:\n%s", rc, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), `nginx_requests_total{site="main",status="404"} 1`) {
+		t.Errorf("unexpected output:\n%s", stdout.String())
+	}
+
+	if rc = run([]string{"replay", "--config", configPath, "--input", "2", "-"}, strings.NewReader(""), &stdout, &stderr); rc != exitError {
+		t.Errorf("missing input: exit code = %d", rc)
+	}
+}
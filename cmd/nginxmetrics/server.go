@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type AuthConfig struct {
+	BearerToken string            `json:"bearer_token,omitempty"`
+	BasicUsers  map[string]string `json:"basic_users,omitempty"`
+}
+
+// ServerConfig configures the HTTP endpoint of a command. MetricsAuth
+// protects /metrics, AdminAuth protects /config and /inspect; the NEL and
+// CSP report endpoints are always open.
+type ServerConfig struct {
+	Listen      string      `json:"listen,omitempty"`
+	TLSCert     string      `json:"tls_cert,omitempty"`
+	TLSKey      string      `json:"tls_key,omitempty"`
+	MetricsAuth *AuthConfig `json:"metrics_auth,omitempty"`
+	AdminAuth   *AuthConfig `json:"admin_auth,omitempty"`
+}
+
+func (a *AuthConfig) enabled() bool {
+	return a != nil && (len(a.BearerToken) > 0 || len(a.BasicUsers) > 0)
+}
+
+func secureCompare(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (a *AuthConfig) authorized(r *http.Request) bool {
+	var header = r.Header.Get("Authorization")
+	if len(a.BearerToken) > 0 && strings.HasPrefix(header, "Bearer ") {
+		return secureCompare(strings.TrimPrefix(header, "Bearer "), a.BearerToken)
+	}
+	if len(a.BasicUsers) > 0 {
+		if user, password, ok := r.BasicAuth(); ok {
+			var expected, found = a.BasicUsers[user]
+			return found && secureCompare(password, expected)
+		}
+	}
+	return false
+}
+
+func requireAuth(a *AuthConfig, h http.Handler) http.Handler {
+	if !a.enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(rsp http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			if len(a.BasicUsers) > 0 {
+				rsp.Header().Set("WWW-Authenticate", `Basic realm="nginxmetrics"`)
+			}
+			http.Error(rsp, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(rsp, r)
+	})
+}
+
+func (s *ServerConfig) validate() error {
+	if (len(s.TLSCert) > 0) != (len(s.TLSKey) > 0) {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	return nil
+}
+
+func serve(s *ServerConfig, handler http.Handler) error {
+	var server = &http.Server{Addr: s.Listen, Handler: handler}
+	if len(s.TLSCert) > 0 {
+		return server.ListenAndServeTLS(s.TLSCert, s.TLSKey)
+	}
+	return server.ListenAndServe()
+}
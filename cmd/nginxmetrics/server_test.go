@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+	var ok = http.HandlerFunc(func(rsp http.ResponseWriter, _ *http.Request) {
+		rsp.WriteHeader(200)
+	})
+	var h = requireAuth(&AuthConfig{
+		BearerToken: "s3cret",
+		BasicUsers:  map[string]string{"prometheus": "pw"},
+	}, ok)
+
+	var cases = []struct {
+		setup  func(r *http.Request)
+		status int
+	}{
+		{func(r *http.Request) {}, 401},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, 200},
+		{func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, 401},
+		{func(r *http.Request) { r.SetBasicAuth("prometheus", "pw") }, 200},
+		{func(r *http.Request) { r.SetBasicAuth("prometheus", "wrong") }, 401},
+		{func(r *http.Request) { r.SetBasicAuth("nobody", "pw") }, 401},
+	}
+	for i, c := range cases {
+		var r = httptest.NewRequest("GET", "/metrics", nil)
+		c.setup(r)
+		var rsp = httptest.NewRecorder()
+		h.ServeHTTP(rsp, r)
+		if rsp.Code != c.status {
+			t.Errorf("case %d: status = %d, expected %d", i, rsp.Code, c.status)
+		}
+	}
+
+	if requireAuth(nil, ok) == nil || requireAuth(&AuthConfig{}, ok) == nil {
+		t.Error("missing handler without auth")
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	var c = findCommand("unique")
+	var config = &config{HTTP: map[string]*ServerConfig{
+		"unique": {Listen: "127.0.0.1:9999", TLSCert: "cert.pem", TLSKey: "key.pem"},
+		"nel":    {TLSCert: "cert.pem"},
+	}}
+	var s, err = c.serverConfig(config, &options{})
+	if err != nil || s.Listen != "127.0.0.1:9999" || s.TLSKey != "key.pem" {
+		t.Errorf("unexpected server config %+v, %v", s, err)
+	}
+	s, _ = c.serverConfig(config, &options{listen: ":1234"})
+	if s.Listen != ":1234" {
+		t.Errorf("--listen not applied: %+v", s)
+	}
+	s, _ = findCommand("standard").serverConfig(config, &options{})
+	if s.Listen != ":9802" {
+		t.Errorf("default listen not applied: %+v", s)
+	}
+	if _, err := findCommand("nel").serverConfig(config, &options{}); err == nil {
+		t.Error("expected error for tls_cert without tls_key")
+	}
+}
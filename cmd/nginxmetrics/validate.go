@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"mxmz.it/nginxmetrics/metrics"
+)
+
+// validateConfig returns every problem found in the config, so that they
+// can all be fixed at once.
+func validateConfig(c *config) metrics.ValidationErrors {
+	var rv = metrics.ValidationErrors{}
+	rv = append(rv, metrics.ValidateMetrics(c.Metrics, "metrics")...)
+	rv = append(rv, metrics.ValidateUnique(c.Unique, "unique")...)
+
+	var duplicates = []string{}
+	for name := range c.Unique {
+		if _, ok := c.Metrics[name]; ok {
+			duplicates = append(duplicates, name)
+		}
+	}
+	sort.Strings(duplicates)
+	for _, name := range duplicates {
+		rv = append(rv, metrics.ValidationError{
+			Path:    metrics.JoinPath("unique", name),
+			Message: "duplicate metric name, also defined in metrics",
+		})
+	}
+
+	rv = append(rv, validateInputs(c)...)
+
+	var servers = make([]string, 0, len(c.HTTP))
+	for name := range c.HTTP {
+		servers = append(servers, name)
+	}
+	sort.Strings(servers)
+	for _, name := range servers {
+		var p = metrics.JoinPath("http", name)
+		if cmd := findCommand(name); cmd == nil || cmd.offline {
+			rv = append(rv, metrics.ValidationError{Path: p, Message: fmt.Sprintf("unknown command %q", name)})
+			continue
+		}
+		if s := c.HTTP[name]; s != nil {
+			if err := s.validate(); err != nil {
+				rv = append(rv, metrics.ValidationError{Path: p, Message: err.Error()})
+			}
+		}
+	}
+	return rv
+}
+
+func doValidate(config *config, opts *options, _ []string) error {
+	var problems = validateConfig(config)
+	for _, p := range problems {
+		fmt.Fprintln(opts.stdout, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %d problems found", opts.configPath, len(problems))
+	}
+	fmt.Fprintf(opts.stdout, "%s: OK\n", opts.configPath)
+	return nil
+}
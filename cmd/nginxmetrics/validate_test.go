@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	var c config
+	var err = json.Unmarshal([]byte(`{
+		"metrics": { "nginx_users": { "type": "count" } },
+		"unique": { "nginx_users": { "value_source": "remote_addr", "time_window": 60 } },
+		"http": { "standrd": {}, "validate": {}, "nel": { "tls_cert": "cert.pem" }, "unique": { "listen": ":1" } }
+	}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{"unique.nginx_users", "http.nel", "http.standrd", "http.validate"}
+	var problems = validateConfig(&c)
+	if len(problems) != len(expected) {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	for i, p := range problems {
+		if p.Path != expected[i] {
+			t.Errorf("problem %d: path = %s, expected %s", i, p.Path, expected[i])
+		}
+	}
+}
@@ -4,9 +4,9 @@ go 1.16
 
 require (
 	github.com/hashicorp/golang-lru v0.5.4
-	github.com/hpcloud/tail v1.0.0
 	github.com/json-iterator/go v1.1.11
 	github.com/prometheus/client_golang v1.11.0
-	gopkg.in/fsnotify.v1 v1.4.7 // indirect
-	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.26.0
+	gopkg.in/fsnotify.v1 v1.4.7
 )
@@ -0,0 +1,157 @@
+package input
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mxmz.it/nginxmetrics/logging"
+)
+
+// backfillFile is a rotated file to read before following the live one.
+// Lines older than since (when set) are skipped.
+type backfillFile struct {
+	path   string
+	offset int64
+	since  time.Time
+}
+
+// rotatedSiblings returns the files logrotate made out of path (path.1,
+// path.2.gz, ...), from the newest to the oldest.
+func rotatedSiblings(path string) []string {
+	var matches, _ = filepath.Glob(path + ".*")
+	var numbered = map[int]string{}
+	var ns = []int{}
+	for _, m := range matches {
+		var suffix = strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".gz")
+		var n, err = strconv.Atoi(suffix)
+		if err != nil || n <= 0 {
+			continue
+		}
+		if _, ok := numbered[n]; ok {
+			continue
+		}
+		numbered[n] = m
+		ns = append(ns, n)
+	}
+	sort.Ints(ns)
+	var rv = make([]string, 0, len(ns))
+	for _, n := range ns {
+		rv = append(rv, numbered[n])
+	}
+	return rv
+}
+
+// planBackfill returns the rotated files of path to read, from the oldest,
+// and the time of the oldest line to read from the live file.
+//
+// When the checkpoint is in a rotated file, that file is read from the
+// checkpoint, then the newer files and the live one entirely. Otherwise the
+// lines of the last window are read from the rotated files modified within
+// the window and from the live file, but not those logged before the
+// checkpoint was reached (its file may have been compressed or deleted).
+func planBackfill(path string, p Position, checkpointed bool, window time.Duration, now time.Time) ([]backfillFile, time.Time) {
+	var since = now.Add(-window)
+	if checkpointed && p.Time.After(since) {
+		since = p.Time
+	}
+	var newer = []backfillFile{}
+	for _, sibling := range rotatedSiblings(path) {
+		var info, err = os.Stat(sibling)
+		if err != nil {
+			continue
+		}
+		if checkpointed && !strings.HasSuffix(sibling, ".gz") && idOf(info) == p.fileID {
+			newer = append(newer, backfillFile{path: sibling, offset: p.Offset})
+			for i := range newer {
+				newer[i].since = time.Time{}
+			}
+			reverse(newer)
+			return newer, time.Time{}
+		}
+		if info.ModTime().Before(since) {
+			break
+		}
+		newer = append(newer, backfillFile{path: sibling, since: since})
+	}
+	reverse(newer)
+	return newer, since
+}
+
+func reverse(files []backfillFile) {
+	for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+		files[i], files[j] = files[j], files[i]
+	}
+}
+
+func openLog(path string) (io.ReadCloser, error) {
+	var f, err = os.Open(path)
+	if err != nil || !strings.HasSuffix(path, ".gz") {
+		return f, err
+	}
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{z, f}, nil
+}
+
+// backfill reads a rotated file to the end, stopping early if stop is
+// closed, and returns the number of lines handled.
+func backfill(b backfillFile, parser Parser, handler Handler, timeField string, stop <-chan struct{}) int64 {
+	var in, err = openLog(b.path)
+	if err != nil {
+		logging.Errorf("backfilling %s: %v", b.path, err)
+		return 0
+	}
+	defer in.Close()
+	var r = bufio.NewReader(in)
+	if b.offset > 0 {
+		if _, err := io.CopyN(io.Discard, r, b.offset); err != nil {
+			logging.Errorf("backfilling %s: %v", b.path, err)
+			return 0
+		}
+	}
+	logging.Infof("backfilling %s from offset %d", b.path, b.offset)
+	var count int64
+	for {
+		var line, err = r.ReadString('\n')
+		if len(line) > 0 {
+			if l, err := parser.Parse(strings.TrimRight(line, "\r\n")); err == nil && !tooOld(l, timeField, b.since) {
+				handler.HandleLogLine(l)
+				count++
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				logging.Errorf("backfilling %s: %v", b.path, err)
+			}
+			return count
+		}
+		select {
+		case <-stop:
+			return count
+		default:
+		}
+	}
+}
+
+// tooOld tells whether a line was logged before since. Lines without a time
+// are never too old.
+func tooOld(l map[string]string, timeField string, since time.Time) bool {
+	if since.IsZero() {
+		return false
+	}
+	var t, ok = EventTime(l, timeField)
+	return ok && t.Before(since)
+}
@@ -0,0 +1,86 @@
+package input
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Position is how far a file has been read, and when.
+type Position struct {
+	fileID
+	Offset int64     `json:"offset"`
+	Time   time.Time `json:"time,omitempty"`
+}
+
+// Checkpoints persists the positions of the followed files, so that they
+// are read from where they were left after a restart.
+type Checkpoints struct {
+	path      string
+	positions map[string]Position
+	lock      sync.Mutex
+}
+
+// LoadCheckpoints reads the checkpoint file at path, which may not exist yet.
+func LoadCheckpoints(path string) (*Checkpoints, error) {
+	var c = &Checkpoints{path: path, positions: map[string]Position{}}
+	var content, err = ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &c.positions); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Checkpoints) get(path string) (Position, bool) {
+	if c == nil {
+		return Position{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var p, ok = c.positions[path]
+	return p, ok
+}
+
+func (c *Checkpoints) set(path string, p Position) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.positions[path] = p
+}
+
+func (c *Checkpoints) delete(path string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.positions, path)
+}
+
+// Save writes the checkpoint file, replacing it atomically.
+func (c *Checkpoints) Save() error {
+	c.lock.Lock()
+	var content, err = json.MarshalIndent(c.positions, "", "\t")
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
@@ -0,0 +1,74 @@
+package input
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var errorLogRe = regexp.MustCompile(`^(\d{4}/\d\d/\d\d \d\d:\d\d:\d\d) \[(debug|info|notice|warn|error|crit|alert|emerg)\] (\d+)#(\d+): (?:\*(\d+) )?(.*)$`)
+
+// errorLogContext matches the context nginx appends to the messages, e.g.
+// `, client: 10.0.0.1, server: example.com, request: "GET / HTTP/1.1"`.
+var errorLogContext = regexp.MustCompile(`, (client|server|request|subrequest|upstream|host|referrer): ("(?:[^"\\]|\\.)*"|[^,]*)`)
+
+var errorKinds = []struct {
+	re   *regexp.Regexp
+	kind string
+}{
+	{regexp.MustCompile(`upstream timed out`), "upstream_timeout"},
+	{regexp.MustCompile(`no live upstreams`), "no_live_upstreams"},
+	{regexp.MustCompile(`connect\(\) (to \S+ )?failed`), "connect_failed"},
+	{regexp.MustCompile(`upstream prematurely closed`), "upstream_closed"},
+	{regexp.MustCompile(`limiting requests`), "limit_req"},
+	{regexp.MustCompile(`limiting connections`), "limit_conn"},
+	{regexp.MustCompile(`client intended to send too large`), "body_too_large"},
+	{regexp.MustCompile(`SSL_do_handshake\(\) failed`), "ssl_handshake_failed"},
+	{regexp.MustCompile(`open\(\) ".*" failed`), "open_failed"},
+}
+
+// errorKind classifies the common error log messages, "other" for the rest.
+func errorKind(message string) string {
+	for _, k := range errorKinds {
+		if k.re.MatchString(message) {
+			return k.kind
+		}
+	}
+	return "other"
+}
+
+// ParseErrorLog parses a line of the nginx error log into time, level, pid,
+// tid, connection (empty when the line has no *id), message, kind and the
+// fields of the context (client, server, request, upstream, host, ...).
+// For compatibility the level is also set as a field valued "1", e.g.
+// "error": "1".
+func ParseErrorLog(line string) (map[string]string, error) {
+	var m = errorLogRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("not an error log line")
+	}
+	var rv = map[string]string{
+		"time":       m[1],
+		"level":      m[2],
+		"pid":        m[3],
+		"tid":        m[4],
+		"connection": m[5],
+		m[2]:         "1",
+	}
+	var message = m[6]
+	var context = errorLogContext.FindAllStringSubmatchIndex(message, -1)
+	// the context is the trailing run of contiguous key: value pairs
+	var start = len(message)
+	for i := len(context) - 1; i >= 0 && context[i][1] == start; i-- {
+		start = context[i][0]
+	}
+	for _, loc := range context {
+		if loc[0] >= start {
+			rv[message[loc[2]:loc[3]]] = strings.Trim(message[loc[4]:loc[5]], `"`)
+		}
+	}
+	message = message[:start]
+	rv["message"] = message
+	rv["kind"] = errorKind(message)
+	return rv, nil
+}
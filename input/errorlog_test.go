@@ -0,0 +1,63 @@
+package input
+
+import (
+	"testing"
+)
+
+func TestParseErrorLog(t *testing.T) {
+	var cases = []struct {
+		line     string
+		expected map[string]string
+	}{
+		{
+			`2021/06/01 10:00:00 [error] 1234#5678: *91 upstream timed out (110: Connection timed out) while reading response header from upstream, client: 10.0.0.9, server: www.example.com, request: "GET /a, b HTTP/1.1", upstream: "http://10.0.0.1:8080/a, b", host: "www.example.com"`,
+			map[string]string{
+				"time": "2021/06/01 10:00:00", "level": "error", "error": "1", "pid": "1234", "tid": "5678", "connection": "91",
+				"message":  "upstream timed out (110: Connection timed out) while reading response header from upstream",
+				"kind":     "upstream_timeout",
+				"client":   "10.0.0.9",
+				"server":   "www.example.com",
+				"request":  "GET /a, b HTTP/1.1",
+				"upstream": "http://10.0.0.1:8080/a, b",
+				"host":     "www.example.com",
+			},
+		},
+		{
+			`2021/06/01 10:00:01 [warn] 1234#5678: *92 limiting requests, excess: 10.500 by zone "one", client: 10.0.0.9, server: , request: "GET / HTTP/1.1"`,
+			map[string]string{
+				"level": "warn", "warn": "1", "kind": "limit_req", "server": "",
+				"message": `limiting requests, excess: 10.500 by zone "one"`,
+			},
+		},
+		{
+			`2021/06/01 10:00:02 [emerg] 1#1: bind() to 0.0.0.0:80 failed (98: Address already in use)`,
+			map[string]string{
+				"level": "emerg", "connection": "", "kind": "other",
+				"message": "bind() to 0.0.0.0:80 failed (98: Address already in use)",
+			},
+		},
+		{
+			`2021/06/01 10:00:03 [error] 7#7: *3 no live upstreams while connecting to upstream, client: 10.0.0.9, server: api, request: "POST /v1 HTTP/2.0", upstream: "http://backend/v1"`,
+			map[string]string{"kind": "no_live_upstreams", "upstream": "http://backend/v1"},
+		},
+		{
+			`2021/06/01 10:00:04 [crit] 7#7: *4 connect() to unix:/run/php.sock failed (2: No such file or directory) while connecting to upstream, client: 10.0.0.9`,
+			map[string]string{"kind": "connect_failed", "crit": "1", "client": "10.0.0.9"},
+		},
+	}
+	for _, c := range cases {
+		var l, err = ParseErrorLog(c.line)
+		if err != nil {
+			t.Errorf("%s: %v", c.line, err)
+			continue
+		}
+		for k, v := range c.expected {
+			if l[k] != v {
+				t.Errorf("%s: %s = %q, expected %q", c.line, k, l[k], v)
+			}
+		}
+	}
+	if _, err := ParseErrorLog(`10.0.0.1 - - [01/Jun/2021:10:00:00 +0200] "GET /[error] HTTP/1.1" 200 1`); err == nil {
+		t.Error("access log line parsed as error log")
+	}
+}
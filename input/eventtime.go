@@ -0,0 +1,42 @@
+package input
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeFields are the fields holding the time of a line, looked for when no
+// field is given.
+var TimeFields = []string{"@timestamp", "time_iso8601", "time_local", "time", "msec"}
+
+var eventTimeLayouts = []string{time.RFC3339Nano, "02/Jan/2006:15:04:05 -0700", "2006/01/02 15:04:05"}
+
+// EventTime returns the time a line was logged, read from field (or the
+// first of TimeFields in the line) as $time_iso8601, $time_local, $msec or
+// as the (local) time of the error log.
+func EventTime(l map[string]string, field string) (time.Time, bool) {
+	var v string
+	if len(field) > 0 {
+		v = l[field]
+	} else {
+		for _, f := range TimeFields {
+			if v = l[f]; len(v) > 0 {
+				break
+			}
+		}
+	}
+	v = strings.TrimSpace(v)
+	if len(v) == 0 {
+		return time.Time{}, false
+	}
+	for _, layout := range eventTimeLayouts {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t, true
+		}
+	}
+	if msec, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Unix(0, int64(msec*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
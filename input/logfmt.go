@@ -0,0 +1,66 @@
+package input
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ParseLogfmt parses lines of space separated key=value pairs, where values
+// with spaces are double quoted Go style (key="a \"b\""). A key without a
+// value is set to "".
+func ParseLogfmt(line string) (map[string]string, error) {
+	var rv = map[string]string{}
+	var i = 0
+	for {
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		if i == len(line) {
+			break
+		}
+		var start = i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '"' {
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("missing key at %d", i)
+		}
+		var key = line[start:i]
+		if i == len(line) || line[i] != '=' {
+			if i < len(line) && line[i] == '"' {
+				return nil, fmt.Errorf("unexpected quote at %d", i)
+			}
+			rv[key] = ""
+			continue
+		}
+		i++
+		if i < len(line) && line[i] == '"' {
+			var end = i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("%s: unterminated quoted value", key)
+			}
+			var v, err = strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			rv[key] = v
+			i = end + 1
+			continue
+		}
+		start = i
+		for i < len(line) && line[i] != ' ' {
+			i++
+		}
+		rv[key] = line[start:i]
+	}
+	if len(rv) == 0 {
+		return nil, fmt.Errorf("no key=value pairs")
+	}
+	return rv, nil
+}
@@ -0,0 +1,462 @@
+package input
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+	"mxmz.it/nginxmetrics/logging"
+)
+
+// pollInterval is how often a file is checked for new lines once it has
+// been read to the end.
+var pollInterval = 250 * time.Millisecond
+
+// Handler receives the parsed lines.
+type Handler interface {
+	HandleLogLine(line map[string]string)
+}
+
+// Source is a glob of files to follow and the parser of each of them.
+type Source struct {
+	Glob   string
+	Parser func(path string) Parser
+}
+
+// FileStatus describes a followed file.
+type FileStatus struct {
+	Path      string     `json:"path"`
+	Glob      string     `json:"glob"`
+	Since     time.Time  `json:"since"`
+	Lines     int64      `json:"lines"`
+	Skipped   int64      `json:"skipped"`
+	Backfill  int64      `json:"backfill"`
+	Offset    int64      `json:"offset"`
+	GoneSince *time.Time `json:"gone_since,omitempty"`
+}
+
+type follower struct {
+	status   FileStatus
+	lines    int64
+	skipped  int64
+	backfill int64
+	position Position
+	stream   bool
+	// rotatedFrom is the file read before the last rotation
+	rotatedFrom fileID
+	lock        sync.Mutex
+	stopCh      chan struct{}
+	done        chan struct{}
+}
+
+// Manager follows the files matching the sources. New files are discovered
+// through inotify on their directories (and a periodic rescan, for the
+// directories that do not exist yet); the files that have been gone for
+// longer than the grace period are no longer followed.
+//
+// The files found on the first scan are read from the end, or from their
+// checkpoint when Resume has been called; the ones created later from the
+// start, unless they are a followed file renamed. The standard input (the Stdin glob) and named pipes are read as
+// streams, as long as they are open.
+type Manager struct {
+	sources     []Source
+	handler     Handler
+	rescan      time.Duration
+	grace       time.Duration
+	checkpoints *Checkpoints
+	maxCatchUp  int64
+	flushEvery  time.Duration
+	window      time.Duration
+	timeField   string
+	scanned     bool
+	files       map[string]*follower
+	lock        sync.Mutex
+}
+
+func NewManager(sources []Source, handler Handler, rescan time.Duration, grace time.Duration) *Manager {
+	return &Manager{
+		sources: sources,
+		handler: handler,
+		rescan:  rescan,
+		grace:   grace,
+		files:   map[string]*follower{},
+	}
+}
+
+// Resume makes the files resume from their position in c, which is saved
+// every flushEvery and when Run returns. No more than maxCatchUp bytes (when
+// positive) are read from the files that are behind.
+func (m *Manager) Resume(c *Checkpoints, flushEvery time.Duration, maxCatchUp int64) {
+	m.checkpoints = c
+	m.flushEvery = flushEvery
+	m.maxCatchUp = maxCatchUp
+}
+
+// Backfill makes the files found on the first scan be preceded by their
+// rotated files not read yet (see planBackfill), or by the lines logged
+// within window when they have no checkpoint. The time of the lines is read
+// from timeField (see EventTime).
+func (m *Manager) Backfill(window time.Duration, timeField string) {
+	m.window = window
+	m.timeField = timeField
+}
+
+// Run follows the files until stop is closed.
+func (m *Manager) Run(stop <-chan struct{}) {
+	var watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		logging.Errorf("inotify unavailable, looking for files every %v: %v", m.rescan, err)
+		watcher = nil
+	}
+	var events <-chan fsnotify.Event
+	var errors <-chan error
+	var watched = map[string]struct{}{}
+	if watcher != nil {
+		defer watcher.Close()
+		events, errors = watcher.Events, watcher.Errors
+	}
+	var ticker = time.NewTicker(m.tick())
+	defer ticker.Stop()
+	var flush <-chan time.Time
+	if m.checkpoints != nil && m.flushEvery > 0 {
+		var flushTicker = time.NewTicker(m.flushEvery)
+		defer flushTicker.Stop()
+		flush = flushTicker.C
+	}
+	defer m.flush()
+	defer m.stopAll()
+	var rescan = true
+	for {
+		if rescan {
+			m.scan(time.Now())
+			if watcher != nil {
+				m.watchDirs(watcher, watched)
+			}
+		}
+		rescan = false
+		select {
+		case <-stop:
+			return
+		case ev := <-events:
+			logging.Debugf("inotify: %v", ev)
+			rescan = m.wantsRescan(ev)
+		case err := <-errors:
+			// events may have been lost
+			logging.Warnf("inotify: %v", err)
+			rescan = true
+		case <-ticker.C:
+			rescan = true
+		case <-flush:
+			m.flush()
+		}
+	}
+}
+
+// wantsRescan tells whether ev may add or remove a file matching a source,
+// or a directory files can match in. The writes to the followed files are
+// ignored: they are read by their followers.
+func (m *Manager) wantsRescan(ev fsnotify.Event) bool {
+	if ev.Op&(fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+		return false
+	}
+	for _, s := range m.sources {
+		if s.Glob == Stdin {
+			continue
+		}
+		if ok, _ := filepath.Match(s.Glob, ev.Name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(filepath.Dir(s.Glob), ev.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// tick is the interval of the rescans, short enough to honor the grace
+// period.
+func (m *Manager) tick() time.Duration {
+	if m.grace > 0 && m.grace < m.rescan {
+		return m.grace
+	}
+	return m.rescan
+}
+
+// watchDirs adds the directories the globs can match files in to the
+// watcher.
+func (m *Manager) watchDirs(watcher *fsnotify.Watcher, watched map[string]struct{}) {
+	for _, s := range m.sources {
+		if s.Glob == Stdin {
+			continue
+		}
+		var dirs, _ = filepath.Glob(filepath.Dir(s.Glob))
+		for _, dir := range dirs {
+			if _, ok := watched[dir]; ok {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				logging.Warnf("watching %s: %v", dir, err)
+				continue
+			}
+			watched[dir] = struct{}{}
+		}
+	}
+}
+
+// scan starts following the new files and stops following the ones gone
+// for longer than the grace period.
+func (m *Manager) scan(now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var present = map[string]struct{}{}
+	for _, s := range m.sources {
+		var files, _ = filepath.Glob(s.Glob)
+		if s.Glob == Stdin {
+			files = []string{Stdin}
+		}
+		for _, path := range files {
+			if _, ok := present[path]; ok {
+				continue
+			}
+			present[path] = struct{}{}
+			if _, ok := m.files[path]; !ok {
+				if f, err := m.follow(s, path, now); err != nil {
+					logging.Errorf("following %s: %v", path, err)
+				} else {
+					m.files[path] = f
+				}
+			}
+		}
+	}
+	for path, f := range m.files {
+		if _, ok := present[path]; ok {
+			f.status.GoneSince = nil
+			continue
+		}
+		if f.status.GoneSince == nil {
+			var since = now
+			f.status.GoneSince = &since
+		}
+		if now.Sub(*f.status.GoneSince) >= m.grace {
+			logging.Infof("%s is gone, no longer following it", path)
+			f.stop()
+			delete(m.files, path)
+			if m.checkpoints != nil {
+				m.checkpoints.delete(path)
+			}
+		}
+	}
+	m.scanned = true
+}
+
+// startOffset returns where to start reading a file from, and the rotated
+// files to read before.
+func (m *Manager) startOffset(path string, info os.FileInfo, now time.Time) (int64, []backfillFile, time.Time) {
+	var size = info.Size()
+	var offset int64
+	var plan []backfillFile
+	var since time.Time
+	if !m.scanned {
+		var p, ok = m.checkpoints.get(path)
+		switch {
+		case ok && p.fileID == idOf(info) && p.Offset <= size:
+			offset = p.Offset
+		case m.window > 0:
+			plan, since = planBackfill(path, p, ok, m.window, now)
+		case !ok:
+			offset = size
+		}
+		// otherwise the file was rotated or truncated while down, and all
+		// of it was written after the checkpoint
+	} else if m.following(idOf(info)) {
+		// a followed file renamed to a name matching a glob, e.g. a rotated
+		// access.log.1: its lines have been read under the old name
+		offset = size
+	}
+	return m.capCatchUp(path, size, offset), plan, since
+}
+
+// following tells whether id is the file read by a follower, or the one it
+// read before its file was rotated. m.lock is held.
+func (m *Manager) following(id fileID) bool {
+	if id == (fileID{}) {
+		return false
+	}
+	for _, f := range m.files {
+		f.lock.Lock()
+		var ok = f.position.fileID == id || f.rotatedFrom == id
+		f.lock.Unlock()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) capCatchUp(path string, size int64, offset int64) int64 {
+	if m.maxCatchUp > 0 && size-offset > m.maxCatchUp {
+		logging.Warnf("%s: %d bytes behind, reading the last %d", path, size-offset, m.maxCatchUp)
+		offset = size - m.maxCatchUp
+	}
+	return offset
+}
+
+func (m *Manager) follow(s Source, path string, now time.Time) (*follower, error) {
+	if path == Stdin {
+		return m.stream(s, path, now)
+	}
+	var info, err = os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if isPipe(info) {
+		return m.stream(s, path, now)
+	}
+	var offset, plan, since = m.startOffset(path, info, now)
+	// the live file is opened first, so that it is not lost if it is rotated
+	// during the backfill
+	t, err := openTailer(path, offset)
+	if err != nil {
+		return nil, err
+	}
+	logging.Infof("following %s from offset %d", path, t.offset)
+	var f = &follower{
+		status:   FileStatus{Path: path, Glob: s.Glob, Since: now},
+		position: Position{t.id, t.offset, now},
+		stopCh:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go f.run(t, s.Parser(path), m.handler, plan, since, info.Size(), m.timeField)
+	return f, nil
+}
+
+// stream reads the standard input or a named pipe.
+func (m *Manager) stream(s Source, path string, now time.Time) (*follower, error) {
+	var r, err = openStream(path)
+	if err != nil {
+		return nil, err
+	}
+	logging.Infof("reading %s", path)
+	var f = &follower{
+		status: FileStatus{Path: path, Glob: s.Glob, Since: now},
+		stream: true,
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go f.runStream(r, s.Parser(path), m.handler)
+	return f, nil
+}
+
+// run reads the backfill plan, then follows the file. The lines up to
+// offset sinceUntil logged before since are skipped.
+func (f *follower) run(t *tailer, parser Parser, handler Handler, plan []backfillFile, since time.Time, sinceUntil int64, timeField string) {
+	defer close(f.done)
+	defer t.close()
+	for _, b := range plan {
+		atomic.AddInt64(&f.backfill, backfill(b, parser, handler, timeField, f.stopCh))
+	}
+	for {
+		var line, err = t.next()
+		if err == nil {
+			if l, err := parser.Parse(line); err != nil {
+				atomic.AddInt64(&f.skipped, 1)
+			} else if t.offset > sinceUntil || !tooOld(l, timeField, since) {
+				handler.HandleLogLine(l)
+				atomic.AddInt64(&f.lines, 1)
+			}
+			f.setPosition(Position{t.id, t.offset, time.Now()})
+			select {
+			case <-f.stopCh:
+				return
+			default:
+			}
+			continue
+		}
+		if err != io.EOF {
+			logging.Errorf("reading %s: %v", t.path, err)
+		}
+		if t.rotated() {
+			var old = t.id
+			if err := t.reopen(); err != nil {
+				logging.Errorf("reopening %s: %v", t.path, err)
+			} else {
+				logging.Infof("%s rotated, reading it from the start", t.path)
+				f.lock.Lock()
+				f.rotatedFrom = old
+				f.lock.Unlock()
+				f.setPosition(Position{t.id, t.offset, time.Now()})
+				continue
+			}
+		}
+		select {
+		case <-f.stopCh:
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func (f *follower) setPosition(p Position) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.position = p
+}
+
+func (f *follower) getPosition() Position {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.position
+}
+
+func (f *follower) stop() {
+	close(f.stopCh)
+	<-f.done
+}
+
+func (m *Manager) stopAll() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, f := range m.files {
+		f.stop()
+	}
+}
+
+// flush saves the positions of the followed files.
+func (m *Manager) flush() {
+	if m.checkpoints == nil {
+		return
+	}
+	m.lock.Lock()
+	for path, f := range m.files {
+		if f.stream {
+			continue
+		}
+		m.checkpoints.set(path, f.getPosition())
+	}
+	m.lock.Unlock()
+	if err := m.checkpoints.Save(); err != nil {
+		logging.Errorf("saving checkpoints: %v", err)
+	}
+}
+
+// Files returns the followed files, sorted by path.
+func (m *Manager) Files() []FileStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var rv = make([]FileStatus, 0, len(m.files))
+	for _, f := range m.files {
+		var s = f.status
+		s.Lines = atomic.LoadInt64(&f.lines)
+		s.Skipped = atomic.LoadInt64(&f.skipped)
+		s.Backfill = atomic.LoadInt64(&f.backfill)
+		s.Offset = f.getPosition().Offset
+		rv = append(rv, s)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Path < rv[j].Path })
+	return rv
+}
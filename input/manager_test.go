@@ -0,0 +1,349 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+type collector struct {
+	lines []map[string]string
+	lock  sync.Mutex
+}
+
+func (c *collector) HandleLogLine(line map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lines = append(c.lines, line)
+}
+
+func (c *collector) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.lines)
+}
+
+func (c *collector) last(field string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.lines) == 0 {
+		return ""
+	}
+	return c.lines[len(c.lines)-1][field]
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func TestManager(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var c = &collector{}
+	var m = NewManager([]Source{{Glob: filepath.Join(dir, "*.log"), Parser: func(string) Parser { return Logfmt }}}, c, time.Minute, 200*time.Millisecond)
+	var stop = make(chan struct{})
+	defer close(stop)
+	go m.Run(stop)
+
+	var path = filepath.Join(dir, "2021-06-01.log")
+	ioutil.WriteFile(path, nil, 0644)
+	waitFor(t, "the file to be followed", func() bool { return len(m.Files()) == 1 })
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("status=200\nstatus=404\nnot logfmt=\"\n")
+	f.Close()
+	waitFor(t, "the lines", func() bool { return c.count() == 2 })
+	waitFor(t, "the skipped line", func() bool { return m.Files()[0].Skipped == 1 })
+	if files := m.Files(); files[0].Path != path || files[0].Lines != 2 {
+		t.Errorf("unexpected status: %+v", files[0])
+	}
+
+	os.Remove(path)
+	waitFor(t, "the file to be dropped", func() bool { return len(m.Files()) == 0 })
+}
+
+func TestManager_RenamedFile(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "access.log")
+	ioutil.WriteFile(path, nil, 0644)
+	var c = &collector{}
+	var m = NewManager([]Source{{Glob: path + "*", Parser: func(string) Parser { return Logfmt }}}, c, time.Minute, time.Minute)
+	var stop = make(chan struct{})
+	defer close(stop)
+	go m.Run(stop)
+	waitFor(t, "the file to be followed", func() bool { return len(m.Files()) == 1 })
+
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	for i := 0; i < 10; i++ {
+		f.WriteString("n=1\n")
+	}
+	f.Close()
+	waitFor(t, "the lines", func() bool { return c.count() == 10 })
+	os.Rename(path, path+".1")
+	ioutil.WriteFile(path, []byte("n=2\n"), 0644)
+	waitFor(t, "the rotated file to be followed", func() bool { return len(m.Files()) == 2 })
+	waitFor(t, "the new line", func() bool { return c.last("n") == "2" })
+	time.Sleep(2 * pollInterval)
+	if c.count() != 11 {
+		t.Errorf("read %d lines", c.count())
+	}
+}
+
+func TestManager_WantsRescan(t *testing.T) {
+	var m = NewManager([]Source{{Glob: "/var/log/nginx/*/access.log"}, {Glob: Stdin}}, nil, time.Minute, time.Minute)
+	for _, c := range []struct {
+		ev   fsnotify.Event
+		want bool
+	}{
+		{fsnotify.Event{Name: "/var/log/nginx/a/access.log", Op: fsnotify.Write}, false},
+		{fsnotify.Event{Name: "/var/log/nginx/a/access.log", Op: fsnotify.Chmod}, false},
+		{fsnotify.Event{Name: "/var/log/nginx/a/access.log", Op: fsnotify.Create}, true},
+		{fsnotify.Event{Name: "/var/log/nginx/a/access.log", Op: fsnotify.Rename}, true},
+		{fsnotify.Event{Name: "/var/log/nginx/a/access.log", Op: fsnotify.Remove}, true},
+		{fsnotify.Event{Name: "/var/log/nginx/a/error.log", Op: fsnotify.Create}, false},
+		{fsnotify.Event{Name: "/var/log/nginx/b", Op: fsnotify.Create}, true},
+	} {
+		if got := m.wantsRescan(c.ev); got != c.want {
+			t.Errorf("wantsRescan(%v) = %v", c.ev, got)
+		}
+	}
+}
+
+func TestTailer(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "tailer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "access.log")
+	ioutil.WriteFile(path, []byte("first\nsecond\nthi"), 0644)
+
+	// 3 is in the middle of the first line, which is skipped
+	tl, err := openTailer(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.close()
+	if line, err := tl.next(); err != nil || line != "second" || tl.offset != 13 {
+		t.Fatalf("next = %q, %v at %d", line, err, tl.offset)
+	}
+	if _, err := tl.next(); err != io.EOF {
+		t.Fatalf("partial line returned: %v", err)
+	}
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("rd\r\n")
+	f.Close()
+	if line, err := tl.next(); err != nil || line != "third" || tl.offset != 20 {
+		t.Fatalf("next = %q, %v at %d", line, err, tl.offset)
+	}
+
+	if tl.rotated() {
+		t.Error("rotated before rotation")
+	}
+	os.Rename(path, path+".1")
+	ioutil.WriteFile(path, []byte("new\n"), 0644)
+	if !tl.rotated() {
+		t.Fatal("rotation not detected")
+	}
+	if err := tl.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := tl.next(); err != nil || line != "new" {
+		t.Fatalf("next = %q, %v", line, err)
+	}
+}
+
+func TestManager_Resume(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "access.log")
+	var checkpointPath = filepath.Join(dir, "checkpoints.json")
+	ioutil.WriteFile(path, []byte("n=1\n"), 0644)
+
+	var run = func(maxCatchUp int64) *collector {
+		var c = &collector{}
+		checkpoints, err := LoadCheckpoints(checkpointPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m = NewManager([]Source{{Glob: path, Parser: func(string) Parser { return Logfmt }}}, c, time.Minute, time.Minute)
+		m.Resume(checkpoints, time.Minute, maxCatchUp)
+		var stop = make(chan struct{})
+		var done = make(chan struct{})
+		go func() {
+			m.Run(stop)
+			close(done)
+		}()
+		waitFor(t, "the file to be followed", func() bool { return len(m.Files()) == 1 })
+		f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+		f.WriteString("n=2\n")
+		f.Close()
+		waitFor(t, "the new line", func() bool { return c.last("n") == "2" })
+		close(stop)
+		<-done
+		return c
+	}
+
+	// no checkpoint: read from the end
+	if c := run(0); c.count() != 1 {
+		t.Errorf("first run read %v", c.lines)
+	}
+	// written while down
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("n=3\nn=4\n")
+	f.Close()
+	if c := run(0); c.count() != 3 || c.lines[0]["n"] != "3" {
+		t.Errorf("second run read %v", c.lines)
+	}
+	f, _ = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("n=5\nn=6\n")
+	f.Close()
+	// only the last 6 bytes: "\nn=6\n" after skipping the rest of n=5
+	if c := run(6); c.count() != 2 || c.lines[0]["n"] != "6" {
+		t.Errorf("third run read %v", c.lines)
+	}
+	// rotated while down: the new file is read from the start
+	os.Rename(path, path+".1")
+	ioutil.WriteFile(path, []byte("n=7\n"), 0644)
+	if c := run(0); c.count() != 2 || c.lines[0]["n"] != "7" {
+		t.Errorf("fourth run read %v", c.lines)
+	}
+}
+
+func TestManager_Backfill(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "access.log")
+	var now = time.Now()
+	var line = func(n string, age time.Duration) string {
+		return "n=" + n + " ts=" + now.Add(-age).Format(time.RFC3339) + "\n"
+	}
+	var gz bytes.Buffer
+	var w = gzip.NewWriter(&gz)
+	w.Write([]byte(line("old", 5*time.Hour) + line("2", 90*time.Minute)))
+	w.Close()
+	ioutil.WriteFile(path+".3.gz", []byte(line("older", 4*time.Hour)), 0644)
+	os.Chtimes(path+".3.gz", now.Add(-4*time.Hour), now.Add(-4*time.Hour))
+	ioutil.WriteFile(path+".2.gz", gz.Bytes(), 0644)
+	ioutil.WriteFile(path+".1", []byte(line("3", time.Hour)+line("4", 30*time.Minute)), 0644)
+	ioutil.WriteFile(path, []byte(line("5", 10*time.Minute)), 0644)
+
+	var run = func(checkpoints *Checkpoints) []string {
+		var c = &collector{}
+		var m = NewManager([]Source{{Glob: path, Parser: func(string) Parser { return Logfmt }}}, c, time.Minute, time.Minute)
+		m.Backfill(2*time.Hour, "ts")
+		if checkpoints != nil {
+			m.Resume(checkpoints, time.Minute, 0)
+		}
+		var stop = make(chan struct{})
+		var done = make(chan struct{})
+		go func() {
+			m.Run(stop)
+			close(done)
+		}()
+		waitFor(t, "the live file", func() bool { return c.last("n") == "5" })
+		// the checkpoints are saved when Run returns
+		close(stop)
+		<-done
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		var rv = []string{}
+		for _, l := range c.lines {
+			rv = append(rv, l["n"])
+		}
+		return rv
+	}
+
+	if got := strings.Join(run(nil), " "); got != "2 3 4 5" {
+		t.Errorf("backfill without checkpoint read %s", got)
+	}
+
+	info, _ := os.Stat(path + ".1")
+	var checkpoints, _ = LoadCheckpoints(filepath.Join(dir, "checkpoints.json"))
+	checkpoints.set(path, Position{idOf(info), int64(len(line("3", time.Hour))), now.Add(-time.Hour)})
+	if got := strings.Join(run(checkpoints), " "); got != "4 5" {
+		t.Errorf("backfill from the checkpoint read %s", got)
+	}
+
+	// the file of the checkpoint has been compressed: only the lines logged
+	// after the checkpoint are read
+	checkpoints.set(path, Position{fileID{1, 2}, 10, now.Add(-45 * time.Minute)})
+	if got := strings.Join(run(checkpoints), " "); got != "4 5" {
+		t.Errorf("backfill after a lost checkpoint read %s", got)
+	}
+}
+
+func TestManager_Streams(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "streams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "access.fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Skip(err)
+	}
+	var r, w = io.Pipe()
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = r
+
+	var c = &collector{}
+	var m = NewManager([]Source{
+		{Glob: Stdin, Parser: func(string) Parser { return Logfmt }},
+		{Glob: path, Parser: func(string) Parser { return Logfmt }},
+	}, c, time.Minute, time.Minute)
+	var stop = make(chan struct{})
+	var done = make(chan struct{})
+	go func() {
+		m.Run(stop)
+		close(done)
+	}()
+	waitFor(t, "the streams to be read", func() bool { return len(m.Files()) == 2 })
+
+	w.Write([]byte("from=stdin\n"))
+	waitFor(t, "the stdin line", func() bool { return c.last("from") == "stdin" })
+	// the pipe is still read after its writers close it
+	for _, line := range []string{"from=fifo1\n", "from=fifo2\n"} {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(line)
+		f.Close()
+	}
+	waitFor(t, "the fifo lines", func() bool { return c.last("from") == "fifo2" })
+	close(stop)
+	<-done
+	if c.count() != 3 {
+		t.Errorf("read %v", c.lines)
+	}
+}
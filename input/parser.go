@@ -0,0 +1,107 @@
+package input
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"mxmz.it/nginxmetrics/metrics"
+)
+
+// Parser turns a log line into the map of fields fed to the metrics.
+type Parser interface {
+	Parse(line string) (map[string]string, error)
+}
+
+// ParserFunc adapts a function to the Parser interface.
+type ParserFunc func(line string) (map[string]string, error)
+
+func (f ParserFunc) Parse(line string) (map[string]string, error) {
+	return f(line)
+}
+
+var ErrUnparsed = errors.New("no parser accepted the line")
+
+// FirstOf returns the fields of the first parser accepting the line.
+type FirstOf []Parser
+
+func (ps FirstOf) Parse(line string) (map[string]string, error) {
+	for _, p := range ps {
+		if l, err := p.Parse(line); err == nil {
+			return l, nil
+		}
+	}
+	return nil, ErrUnparsed
+}
+
+// jsonAPI keeps numbers as json.Number, so that they are not rounded
+// through float64.
+var jsonAPI = jsoniter.Config{EscapeHTML: true, SortMapKeys: true, ValidateJsonRawMessage: true, UseNumber: true}.Froze()
+
+// JSON parses the lines that are JSON objects, flattened by
+// metrics.StringizeMap.
+var JSON Parser = ParserFunc(func(line string) (map[string]string, error) {
+	if !strings.HasPrefix(line, "{") {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	var lineMap map[string]interface{}
+	if err := jsonAPI.Unmarshal([]byte(line), &lineMap); err != nil {
+		return nil, err
+	}
+	return metrics.StringizeMap(lineMap), nil
+})
+
+// ErrorLog parses the lines of the nginx error log with ParseErrorLog.
+var ErrorLog Parser = ParserFunc(ParseErrorLog)
+
+// Logfmt parses key=value lines with ParseLogfmt.
+var Logfmt Parser = ParserFunc(ParseLogfmt)
+
+// ParserConfig selects a parser by name, with the options some of them need.
+type ParserConfig struct {
+	Parser    string `json:"parser,omitempty"`
+	LogFormat string `json:"log_format,omitempty"`
+	Regex     string `json:"regex,omitempty"`
+}
+
+var ParserNames = []string{"auto", "json", "text", "error", "logfmt", "regex"}
+
+// NewParser returns the parser of the config. "auto", the default, tries
+// JSON, then the error log, whose lines are easier to tell apart, then
+// LogFormat when set.
+func NewParser(c ParserConfig) (Parser, error) {
+	var format *TextFormat
+	if len(c.LogFormat) > 0 {
+		var err error
+		format, err = NewTextFormat(c.LogFormat)
+		if err != nil {
+			return nil, fmt.Errorf("log_format: %v", err)
+		}
+	}
+	switch c.Parser {
+	case "", "auto":
+		if format == nil {
+			return FirstOf{JSON, ErrorLog}, nil
+		}
+		return FirstOf{JSON, ErrorLog, format}, nil
+	case "json":
+		return JSON, nil
+	case "text":
+		if format == nil {
+			return nil, fmt.Errorf("parser text needs a log_format")
+		}
+		return format, nil
+	case "error":
+		return ErrorLog, nil
+	case "logfmt":
+		return Logfmt, nil
+	case "regex":
+		var p, err = NewRegex(c.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("regex: %v", err)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown parser %q, expected one of %s", c.Parser, strings.Join(ParserNames, ", "))
+}
@@ -0,0 +1,76 @@
+package input
+
+import (
+	"testing"
+)
+
+func TestParseLogfmt(t *testing.T) {
+	var l, err = ParseLogfmt(`time=2021-06-01T10:00:00Z host=www.example.com status=200 ua="curl/7.68.0 \"x\"" cached request_time=0.125`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = map[string]string{
+		"time": "2021-06-01T10:00:00Z", "host": "www.example.com", "status": "200",
+		"ua": `curl/7.68.0 "x"`, "cached": "", "request_time": "0.125",
+	}
+	if len(l) != len(expected) {
+		t.Errorf("unexpected fields: %v", l)
+	}
+	for k, v := range expected {
+		if l[k] != v {
+			t.Errorf("%s = %q, expected %q", k, l[k], v)
+		}
+	}
+	for _, line := range []string{``, `a="unterminated`, `="x"`, `a "b"`} {
+		if _, err := ParseLogfmt(line); err == nil {
+			t.Errorf("%q parsed", line)
+		}
+	}
+}
+
+func TestNewParser(t *testing.T) {
+	var p, err = NewParser(ParserConfig{Parser: "regex", Regex: `^(?P<host>\S+) (?P<status>\d+) (?P<request_time>[\d.]+)$`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := p.Parse("www.example.com 503 1.5")
+	if err != nil || l["host"] != "www.example.com" || l["status"] != "503" || l["request_time"] != "1.5" {
+		t.Errorf("unexpected fields: %v (%v)", l, err)
+	}
+	if _, err := p.Parse("www.example.com - 1.5"); err == nil {
+		t.Error("unmatched line parsed")
+	}
+
+	auto, err := NewParser(ParserConfig{LogFormat: "$host $status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for line, field := range map[string]string{
+		`{"host": "www.example.com"}`: "host",
+		`www.example.com 200`:         "status",
+		`2021/06/01 10:00:00 [error] 1#1: *1 upstream timed out, client: 10.0.0.1`: "level",
+	} {
+		if l, err := auto.Parse(line); err != nil || len(l[field]) == 0 {
+			t.Errorf("%s: unexpected fields: %v (%v)", line, l, err)
+		}
+	}
+	if _, err := auto.Parse("garbage"); err != ErrUnparsed {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, c := range []ParserConfig{{Parser: "regex", Regex: `\d+`}, {Parser: "regex", Regex: `(`}, {Parser: "text"}, {Parser: "csv"}} {
+		if _, err := NewParser(c); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+}
+
+func TestJSON_Numbers(t *testing.T) {
+	var l, err = JSON.Parse(`{"bytes": 12345678901234567890, "rt": 1e-7, "geo": {"country": "IT"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l["bytes"] != "12345678901234567890" || l["rt"] != "1e-7" || l["geo.country"] != "IT" {
+		t.Errorf("unexpected fields: %v", l)
+	}
+}
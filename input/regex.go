@@ -0,0 +1,42 @@
+package input
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Regex parses lines with a regular expression, whose named groups are the
+// fields.
+type Regex struct {
+	re     *regexp.Regexp
+	fields []string
+}
+
+func NewRegex(expr string) (*Regex, error) {
+	var re, err = regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	var named = false
+	for _, name := range re.SubexpNames() {
+		named = named || len(name) > 0
+	}
+	if !named {
+		return nil, fmt.Errorf("%q has no named groups", expr)
+	}
+	return &Regex{re, re.SubexpNames()}, nil
+}
+
+func (r *Regex) Parse(line string) (map[string]string, error) {
+	var m = r.re.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("line does not match %s", r.re)
+	}
+	var rv = map[string]string{}
+	for i, name := range r.fields {
+		if len(name) > 0 {
+			rv[name] = m[i]
+		}
+	}
+	return rv, nil
+}
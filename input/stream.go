@@ -0,0 +1,84 @@
+package input
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"mxmz.it/nginxmetrics/logging"
+)
+
+// Stdin is the glob of a source reading the standard input.
+const Stdin = "-"
+
+var stdin io.Reader = os.Stdin
+
+func isPipe(info os.FileInfo) bool {
+	return info.Mode()&os.ModeNamedPipe != 0
+}
+
+// openStream opens the standard input or a named pipe. The pipe is opened
+// for writing too, so that opening it does not wait for a writer and reading
+// it does not end when the writers close it.
+func openStream(path string) (io.ReadCloser, error) {
+	if path == Stdin {
+		return ioutil.NopCloser(stdin), nil
+	}
+	return os.OpenFile(path, os.O_RDWR, 0)
+}
+
+// runStream feeds the lines of r to handler until r ends or the follower is
+// stopped. Streams have no offset: they are not checkpointed.
+func (f *follower) runStream(r io.ReadCloser, parser Parser, handler Handler) {
+	defer close(f.done)
+	defer r.Close()
+	var lines = make(chan string)
+	go readLines(f.status.Path, r, lines, f.stopCh)
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		case line, ok := <-lines:
+			if !ok {
+				logging.Infof("%s closed", f.status.Path)
+				return
+			}
+			if l, err := parser.Parse(line); err != nil {
+				atomic.AddInt64(&f.skipped, 1)
+			} else {
+				handler.HandleLogLine(l)
+				atomic.AddInt64(&f.lines, 1)
+			}
+		}
+	}
+}
+
+// readLines sends the lines of r to lines, which is closed when r ends. A
+// read blocked on the standard input is left behind when stop is closed.
+func readLines(path string, r io.Reader, lines chan<- string, stop <-chan struct{}) {
+	defer close(lines)
+	var br = bufio.NewReader(r)
+	for {
+		var line, err = br.ReadString('\n')
+		if len(line) > 0 {
+			select {
+			case lines <- strings.TrimRight(line, "\r\n"):
+			case <-stop:
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case <-stop:
+			default:
+				if err != io.EOF {
+					logging.Errorf("reading %s: %v", path, err)
+				}
+			}
+			return
+		}
+	}
+}
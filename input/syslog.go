@@ -0,0 +1,236 @@
+package input
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"mxmz.it/nginxmetrics/logging"
+)
+
+// syslogQueue is the number of datagrams waiting to be parsed before new
+// ones are dropped.
+var syslogQueue = 4096
+
+// Syslog receives log lines as syslog datagrams, such as the ones nginx
+// sends with access_log syslog:server=...
+type Syslog struct {
+	listen    string
+	conn      net.PacketConn
+	parser    Parser
+	handler   Handler
+	queue     chan []byte
+	received  prometheus.Counter
+	malformed prometheus.Counter
+	dropped   prometheus.Counter
+}
+
+func syslogCounter(r prometheus.Registerer, name string, help string) (*prometheus.CounterVec, error) {
+	var c = prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, []string{"listen"})
+	if err := r.Register(c); err != nil {
+		if already, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return already.ExistingCollector.(*prometheus.CounterVec), nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// ListenSyslog listens on udp://HOST:PORT or unix:///PATH (a unix datagram
+// socket) and registers its counters to r.
+func ListenSyslog(listen string, parser Parser, handler Handler, r prometheus.Registerer) (*Syslog, error) {
+	var network, address, err = SplitSyslogAddress(listen)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unixgram" {
+		// a socket left by a previous run is replaced, anything else is kept
+		if info, err := os.Lstat(address); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s exists and is not a socket", address)
+			}
+			os.Remove(address)
+		}
+	}
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	var s = &Syslog{listen: listen, conn: conn, parser: parser, handler: handler, queue: make(chan []byte, syslogQueue)}
+	for _, c := range []struct {
+		counter *prometheus.Counter
+		name    string
+		help    string
+	}{
+		{&s.received, "nginxmetrics_syslog_received_total", "Syslog datagrams received."},
+		{&s.malformed, "nginxmetrics_syslog_malformed_total", "Syslog datagrams whose envelope or message could not be parsed."},
+		{&s.dropped, "nginxmetrics_syslog_dropped_total", "Syslog datagrams dropped because too many were waiting to be parsed."},
+	} {
+		var vec, err = syslogCounter(r, c.name, c.help)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		*c.counter = vec.WithLabelValues(listen)
+	}
+	return s, nil
+}
+
+// SplitSyslogAddress returns the network and the address of a syslog
+// input.
+func SplitSyslogAddress(listen string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(listen, "udp://"):
+		return "udp", strings.TrimPrefix(listen, "udp://"), nil
+	case strings.HasPrefix(listen, "unix://"):
+		return "unixgram", strings.TrimPrefix(listen, "unix://"), nil
+	}
+	return "", "", fmt.Errorf("unsupported syslog address %q, expected udp://HOST:PORT or unix:///PATH", listen)
+}
+
+// Addr returns the address the datagrams are received on.
+func (s *Syslog) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Run receives the datagrams until Close is called.
+func (s *Syslog) Run() {
+	logging.Infof("receiving syslog on %s", s.listen)
+	go s.handle()
+	defer close(s.queue)
+	var buf = make([]byte, 64*1024)
+	for {
+		var n, _, err = s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		s.received.Inc()
+		var datagram = make([]byte, n)
+		copy(datagram, buf[:n])
+		select {
+		case s.queue <- datagram:
+		default:
+			s.dropped.Inc()
+		}
+	}
+}
+
+func (s *Syslog) handle() {
+	for datagram := range s.queue {
+		var fields, message, err = ParseSyslog(string(datagram))
+		if err != nil {
+			s.malformed.Inc()
+			continue
+		}
+		l, err := s.parser.Parse(message)
+		if err != nil {
+			s.malformed.Inc()
+			continue
+		}
+		for k, v := range fields {
+			if _, ok := l[k]; !ok {
+				l[k] = v
+			}
+		}
+		s.handler.HandleLogLine(l)
+	}
+}
+
+func (s *Syslog) Close() error {
+	return s.conn.Close()
+}
+
+// ParseSyslog strips the RFC 3164 or RFC 5424 envelope from a syslog
+// message, returning the tag (the app name in RFC 5424) and the hostname as
+// syslog_tag and syslog_hostname.
+func ParseSyslog(datagram string) (map[string]string, string, error) {
+	datagram = strings.TrimRight(datagram, "\r\n\x00")
+	var end = strings.IndexByte(datagram, '>')
+	if !strings.HasPrefix(datagram, "<") || end < 2 || end > 4 {
+		return nil, "", fmt.Errorf("missing priority")
+	}
+	if pri, err := strconv.Atoi(datagram[1:end]); err != nil || pri > 191 {
+		return nil, "", fmt.Errorf("invalid priority %q", datagram[1:end])
+	}
+	var rest = datagram[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		return parseRFC5424(rest[2:])
+	}
+	return parseRFC3164(rest)
+}
+
+// parseRFC5424 parses TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG.
+func parseRFC5424(rest string) (map[string]string, string, error) {
+	var parts = strings.SplitN(rest, " ", 6)
+	if len(parts) < 6 {
+		return nil, "", fmt.Errorf("truncated RFC 5424 header")
+	}
+	var fields = map[string]string{"syslog_hostname": nilValue(parts[1]), "syslog_tag": nilValue(parts[2])}
+	var sd = parts[5]
+	if strings.HasPrefix(sd, "-") {
+		sd = sd[1:]
+	} else {
+		// skip the structured data elements, whose values can hold
+		// escaped \] and spaces
+		for strings.HasPrefix(sd, "[") {
+			var i = 1
+			for ; i < len(sd) && sd[i] != ']'; i++ {
+				if sd[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(sd) {
+				return nil, "", fmt.Errorf("unterminated structured data")
+			}
+			sd = sd[i+1:]
+		}
+	}
+	sd = strings.TrimPrefix(sd, " ")
+	return fields, strings.TrimPrefix(sd, "\ufeff"), nil
+}
+
+func nilValue(v string) string {
+	if v == "-" {
+		return ""
+	}
+	return v
+}
+
+// parseRFC3164 parses [TIMESTAMP] [HOSTNAME] TAG[PID]: MSG.
+func parseRFC3164(rest string) (map[string]string, string, error) {
+	// Mmm dd hh:mm:ss
+	if len(rest) > 16 && rest[3] == ' ' && rest[6] == ' ' && rest[9] == ':' && rest[15] == ' ' {
+		rest = rest[16:]
+	}
+	var fields = map[string]string{}
+	var sp = strings.IndexByte(rest, ' ')
+	if sp < 0 {
+		return nil, "", fmt.Errorf("missing tag")
+	}
+	if !strings.HasSuffix(rest[:sp], ":") {
+		fields["syslog_hostname"] = rest[:sp]
+		rest = rest[sp+1:]
+	}
+	var colon = strings.Index(rest, ": ")
+	if colon < 0 {
+		if !strings.HasSuffix(rest, ":") {
+			return nil, "", fmt.Errorf("missing tag")
+		}
+		colon = len(rest) - 1
+	}
+	var tag = rest[:colon]
+	if strings.ContainsRune(tag, ' ') {
+		return nil, "", fmt.Errorf("missing tag")
+	}
+	if i := strings.IndexByte(tag, '['); i >= 0 {
+		tag = tag[:i]
+	}
+	fields["syslog_tag"] = tag
+	if colon+2 > len(rest) {
+		return fields, "", nil
+	}
+	return fields, rest[colon+2:], nil
+}
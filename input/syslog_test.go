@@ -0,0 +1,108 @@
+package input
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseSyslog(t *testing.T) {
+	var cases = []struct {
+		datagram, tag, hostname, message string
+	}{
+		{`<190>Jun  1 10:00:00 web1 nginx: {"status": 200}`, "nginx", "web1", `{"status": 200}`},
+		{`<190>Jun  1 10:00:00 nginx_access[123]: status=200`, "nginx_access", "", "status=200"},
+		{"<190>1 2021-06-01T10:00:00Z web1 nginx 123 - - status=200\n", "nginx", "web1", "status=200"},
+		{`<190>1 2021-06-01T10:00:00Z - nginx - access [meta a="1\]" b="2"][x y="z"] status=200`, "nginx", "", "status=200"},
+	}
+	for _, c := range cases {
+		var fields, message, err = ParseSyslog(c.datagram)
+		if err != nil {
+			t.Errorf("%s: %v", c.datagram, err)
+			continue
+		}
+		if fields["syslog_tag"] != c.tag || fields["syslog_hostname"] != c.hostname || message != c.message {
+			t.Errorf("%s: got %v %q", c.datagram, fields, message)
+		}
+	}
+	for _, datagram := range []string{`status=200`, `<999>Jun  1 10:00:00 nginx: x`, `<190>no tag here`, `<190>1 2021-06-01T10:00:00Z web1`} {
+		if _, _, err := ParseSyslog(datagram); err == nil {
+			t.Errorf("%s: parsed", datagram)
+		}
+	}
+}
+
+func TestSyslog(t *testing.T) {
+	var c = &collector{}
+	var r = prometheus.NewRegistry()
+	var s, err = ListenSyslog("udp://127.0.0.1:0", Logfmt, c, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go s.Run()
+
+	conn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, datagram := range []string{
+		`<190>Jun  1 10:00:00 web1 nginx: status=200`,
+		`not syslog`,
+		`<190>Jun  1 10:00:00 web1 nginx: status="unterminated`,
+		`<190>Jun  1 10:00:00 web1 nginx: status=404`,
+	} {
+		conn.Write([]byte(datagram))
+	}
+	waitFor(t, "the lines", func() bool { return c.last("status") == "404" })
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.lines[0]["status"] != "200" || c.lines[0]["syslog_tag"] != "nginx" || c.lines[0]["syslog_hostname"] != "web1" {
+		t.Errorf("unexpected fields: %v", c.lines[0])
+	}
+	var counters = map[string]float64{
+		"nginxmetrics_syslog_received_total":  4,
+		"nginxmetrics_syslog_malformed_total": 2,
+		"nginxmetrics_syslog_dropped_total":   0,
+	}
+	families, _ := r.Gather()
+	for _, f := range families {
+		if v := f.GetMetric()[0].GetCounter().GetValue(); v != counters[f.GetName()] {
+			t.Errorf("%s = %v, expected %v", f.GetName(), v, counters[f.GetName()])
+		}
+	}
+	if len(families) != 3 {
+		t.Errorf("%d families, expected 3", len(families))
+	}
+}
+
+func TestSyslog_Unix(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "nginx.sock")
+	for i := 0; i < 2; i++ {
+		// the socket left by the first listener is replaced
+		var s, err = ListenSyslog("unix://"+path, Logfmt, &collector{}, prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+
+	var file = filepath.Join(dir, "access.log")
+	ioutil.WriteFile(file, []byte("keep me\n"), 0644)
+	if _, err := ListenSyslog("unix://"+file, Logfmt, &collector{}, prometheus.NewRegistry()); err == nil {
+		t.Error("listening on a regular file")
+	}
+	if content, _ := ioutil.ReadFile(file); string(content) != "keep me\n" {
+		t.Errorf("file changed to %q", content)
+	}
+}
@@ -0,0 +1,108 @@
+package input
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// fileID identifies a file across renames.
+type fileID struct {
+	Dev   uint64 `json:"dev"`
+	Inode uint64 `json:"inode"`
+}
+
+func idOf(info os.FileInfo) fileID {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fileID{uint64(st.Dev), uint64(st.Ino)}
+	}
+	return fileID{}
+}
+
+// tailer reads the lines appended to a file and knows the offset of the
+// end of the last complete line read.
+type tailer struct {
+	path      string
+	file      *os.File
+	reader    *bufio.Reader
+	id        fileID
+	offset    int64
+	partial   []byte
+	skipFirst bool
+}
+
+// openTailer opens path at offset. When offset is not at the start of a
+// line, the rest of that line is skipped.
+func openTailer(path string, offset int64) (*tailer, error) {
+	var f, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if offset > info.Size() {
+		offset = 0
+	}
+	var t = &tailer{path: path, file: f, id: idOf(info), offset: offset}
+	if offset > 0 {
+		var b = make([]byte, 1)
+		if _, err := f.ReadAt(b, offset-1); err == nil && b[0] != '\n' {
+			t.skipFirst = true
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	t.reader = bufio.NewReader(f)
+	return t, nil
+}
+
+// next returns the next complete line, io.EOF when there is none yet.
+func (t *tailer) next() (string, error) {
+	for {
+		var b, err = t.reader.ReadBytes('\n')
+		t.partial = append(t.partial, b...)
+		if err != nil {
+			return "", err
+		}
+		var line = string(t.partial)
+		t.offset += int64(len(t.partial))
+		t.partial = t.partial[:0]
+		if t.skipFirst {
+			t.skipFirst = false
+			continue
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// rotated tells whether path is now another file, or the file has been
+// truncated.
+func (t *tailer) rotated() bool {
+	var info, err = os.Stat(t.path)
+	if err != nil {
+		return false
+	}
+	return idOf(info) != t.id || info.Size() < t.offset+int64(len(t.partial))
+}
+
+// reopen reads path again from the start.
+func (t *tailer) reopen() error {
+	var n, err = openTailer(t.path, 0)
+	if err != nil {
+		return err
+	}
+	t.close()
+	*t = *n
+	return nil
+}
+
+func (t *tailer) close() {
+	t.file.Close()
+}
@@ -0,0 +1,136 @@
+package input
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Presets are the log formats predefined by nginx ("combined") or by its
+// default nginx.conf ("main").
+var Presets = map[string]string{
+	"combined": `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+	"main":     `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" "$http_x_forwarded_for"`,
+}
+
+var variableRe = regexp.MustCompile(`\$(?:\{([a-zA-Z0-9_]+)\}|([a-zA-Z0-9_]+))`)
+
+// TextFormat parses the lines written by nginx with a log_format.
+type TextFormat struct {
+	re     *regexp.Regexp
+	fields []string
+}
+
+// NewTextFormat compiles a log_format definition, or the name of one of the
+// Presets.
+func NewTextFormat(format string) (*TextFormat, error) {
+	if preset, ok := Presets[format]; ok {
+		format = preset
+	}
+	var locs = variableRe.FindAllStringSubmatchIndex(format, -1)
+	if len(locs) == 0 {
+		return nil, fmt.Errorf("log format %q has no variables", format)
+	}
+	var f = &TextFormat{}
+	var expr strings.Builder
+	expr.WriteString("^")
+	var pos = 0
+	for i, loc := range locs {
+		expr.WriteString(regexp.QuoteMeta(format[pos:loc[0]]))
+		var name string
+		if loc[2] >= 0 {
+			name = format[loc[2]:loc[3]]
+		} else {
+			name = format[loc[4]:loc[5]]
+		}
+		pos = loc[1]
+		// a value runs up to the first character of the text that follows
+		// it, which nginx escapes inside values
+		switch {
+		case isUpstreamList(name):
+			var stop = " ,"
+			if pos < len(format) && !strings.ContainsRune(stop, rune(format[pos])) {
+				stop += format[pos : pos+1]
+			}
+			var element = "[^" + regexp.QuoteMeta(stop) + "]*"
+			expr.WriteString("(" + element + "(?:(?:, | : )" + element + ")*)")
+		case i+1 < len(locs) && locs[i+1][0] == pos:
+			expr.WriteString("(.*?)")
+		case pos < len(format):
+			expr.WriteString("([^" + regexp.QuoteMeta(format[pos:pos+1]) + "]*)")
+		default:
+			expr.WriteString("(.*)")
+		}
+		f.fields = append(f.fields, name)
+	}
+	expr.WriteString(regexp.QuoteMeta(format[pos:]))
+	expr.WriteString("$")
+	var err error
+	f.re, err = regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// isUpstreamList tells whether a variable holds a value per upstream server
+// tried, joined by ", " (and " : " across internal redirects), such as
+// $upstream_response_time. The header and cookie values are free text.
+func isUpstreamList(name string) bool {
+	for _, prefix := range []string{"upstream_http_", "upstream_cookie_", "upstream_trailer_"} {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return strings.HasPrefix(name, "upstream_")
+}
+
+// Parse returns the values of the variables of the format. Values logged as
+// "-" are empty, and $request is also split into request_method,
+// request_uri and server_protocol.
+func (f *TextFormat) Parse(line string) (map[string]string, error) {
+	var m = f.re.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("line does not match the log format")
+	}
+	var rv = make(map[string]string, len(f.fields)+3)
+	for i, name := range f.fields {
+		var v = m[i+1]
+		if v == "-" {
+			v = ""
+		}
+		rv[name] = unescape(v)
+	}
+	if request, ok := rv["request"]; ok {
+		var parts = strings.SplitN(request, " ", 3)
+		if len(parts) == 3 {
+			for i, name := range []string{"request_method", "request_uri", "server_protocol"} {
+				if _, ok := rv[name]; !ok {
+					rv[name] = parts[i]
+				}
+			}
+		}
+	}
+	return rv, nil
+}
+
+// unescape decodes the \xHH sequences nginx writes for quotes, backslashes
+// and non printable characters.
+func unescape(v string) string {
+	if !strings.Contains(v, `\x`) {
+		return v
+	}
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] == '\\' && i+3 < len(v) && v[i+1] == 'x' {
+			if c, err := strconv.ParseUint(v[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
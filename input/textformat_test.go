@@ -0,0 +1,82 @@
+package input
+
+import (
+	"testing"
+)
+
+func TestTextFormat_Combined(t *testing.T) {
+	var f, err = NewTextFormat("combined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := f.Parse(`192.168.1.10 - - [01/Jun/2021:10:00:00 +0200] "GET /api/v1/users?id=3 HTTP/1.1" 200 612 "-" "curl/7.68.0 \x22quoted\x22"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = map[string]string{
+		"remote_addr":     "192.168.1.10",
+		"remote_user":     "",
+		"time_local":      "01/Jun/2021:10:00:00 +0200",
+		"request":         "GET /api/v1/users?id=3 HTTP/1.1",
+		"request_method":  "GET",
+		"request_uri":     "/api/v1/users?id=3",
+		"server_protocol": "HTTP/1.1",
+		"status":          "200",
+		"body_bytes_sent": "612",
+		"http_referer":    "",
+		"http_user_agent": `curl/7.68.0 "quoted"`,
+	}
+	if len(l) != len(expected) {
+		t.Errorf("unexpected fields: %v", l)
+	}
+	for k, v := range expected {
+		if l[k] != v {
+			t.Errorf("%s = %q, expected %q", k, l[k], v)
+		}
+	}
+	if _, err := f.Parse(`{"status": 200}`); err == nil {
+		t.Error("JSON line parsed as combined")
+	}
+}
+
+func TestTextFormat_Custom(t *testing.T) {
+	var f, err = NewTextFormat(`$host:$server_port ${request_time}s $upstream_response_time`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := f.Parse(`www.example.com:443 0.125s 0.010, 0.020 : 0.003`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l["host"] != "www.example.com" || l["server_port"] != "443" || l["request_time"] != "0.125" || l["upstream_response_time"] != "0.010, 0.020 : 0.003" {
+		t.Errorf("unexpected fields: %v", l)
+	}
+	if _, err := NewTextFormat("no variables"); err == nil {
+		t.Error("format without variables accepted")
+	}
+}
+
+func TestTextFormat_UpstreamLists(t *testing.T) {
+	var f, err = NewTextFormat(`$remote_addr $request_time $upstream_response_time $upstream_addr "$upstream_status" $upstream_cache_status`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// retried on a second server, then redirected internally
+	l, err := f.Parse(`10.1.1.1 0.030 0.010, 0.020 : 0.003 10.0.0.1:80, 10.0.0.2:80 : unix:/run/app.sock "502, 200 : 200" HIT`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = map[string]string{
+		"remote_addr":            "10.1.1.1",
+		"request_time":           "0.030",
+		"upstream_response_time": "0.010, 0.020 : 0.003",
+		"upstream_addr":          "10.0.0.1:80, 10.0.0.2:80 : unix:/run/app.sock",
+		"upstream_status":        "502, 200 : 200",
+		"upstream_cache_status":  "HIT",
+	}
+	for k, v := range expected {
+		if l[k] != v {
+			t.Errorf("%s = %q, expected %q", k, l[k], v)
+		}
+	}
+}
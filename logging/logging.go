@@ -0,0 +1,57 @@
+// Package logging is a thin leveled wrapper around the standard logger.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+var current = int32(Info)
+
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(levelNames, ", "))
+}
+
+func SetLevel(l Level) {
+	atomic.StoreInt32(&current, int32(l))
+}
+
+func Enabled(l Level) bool {
+	return int32(l) >= atomic.LoadInt32(&current)
+}
+
+func logf(l Level, format string, args ...interface{}) {
+	if Enabled(l) {
+		log.Output(3, strings.ToUpper(l.String())+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+func Debugf(format string, args ...interface{}) { logf(Debug, format, args...) }
+func Infof(format string, args ...interface{})  { logf(Info, format, args...) }
+func Warnf(format string, args ...interface{})  { logf(Warn, format, args...) }
+func Errorf(format string, args ...interface{}) { logf(Error, format, args...) }
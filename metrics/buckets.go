@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type LinearBucketsConfig struct {
+	Start float64 `json:"start"`
+	Width float64 `json:"width"`
+	Count int     `json:"count"`
+}
+
+type ExponentialBucketsConfig struct {
+	Start  float64 `json:"start"`
+	Factor float64 `json:"factor"`
+	Count  int     `json:"count"`
+}
+
+// histogramBuckets returns the upper bounds configured for a histogram,
+// falling back to prometheus.DefBuckets when none are given.
+func histogramBuckets(c *MetricConfig) ([]float64, error) {
+	var set = 0
+	if len(c.Buckets) > 0 {
+		set++
+	}
+	if c.LinearBuckets != nil {
+		set++
+	}
+	if c.ExponentialBuckets != nil {
+		set++
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("only one of buckets, linear_buckets and exponential_buckets can be set")
+	}
+
+	switch {
+	case len(c.Buckets) > 0:
+		for i := 1; i < len(c.Buckets); i++ {
+			if c.Buckets[i] <= c.Buckets[i-1] {
+				return nil, fmt.Errorf("buckets must be in strictly increasing order")
+			}
+		}
+		return c.Buckets, nil
+	case c.LinearBuckets != nil:
+		var b = c.LinearBuckets
+		if b.Count < 1 {
+			return nil, fmt.Errorf("linear_buckets: count must be positive")
+		}
+		if b.Width <= 0 {
+			return nil, fmt.Errorf("linear_buckets: width must be positive")
+		}
+		return prometheus.LinearBuckets(b.Start, b.Width, b.Count), nil
+	case c.ExponentialBuckets != nil:
+		var b = c.ExponentialBuckets
+		if b.Count < 1 {
+			return nil, fmt.Errorf("exponential_buckets: count must be positive")
+		}
+		if b.Start <= 0 {
+			return nil, fmt.Errorf("exponential_buckets: start must be positive")
+		}
+		if b.Factor <= 1 {
+			return nil, fmt.Errorf("exponential_buckets: factor must be greater than 1")
+		}
+		return prometheus.ExponentialBuckets(b.Start, b.Factor, b.Count), nil
+	}
+	return prometheus.DefBuckets, nil
+}
@@ -1,24 +1,15 @@
 package metrics
 
-import "regexp"
+import "time"
 
-type injectLineFunc func(line map[string]string)
+// injectLineFunc feeds a line logged at time t to a metric and tells
+// whether the metric used it.
+type injectLineFunc func(line map[string]string, t time.Time) bool
 
-func keys(m map[string]string) []string {
+func keys(m LabelMap) []string {
 	l := []string{}
 	for k := range m {
 		l = append(l, k)
 	}
 	return l
 }
-
-func makeIfMatchMap(m map[string]string) map[string]*regexp.Regexp {
-	if m == nil {
-		return nil
-	}
-	var rv = map[string]*regexp.Regexp{}
-	for k, v := range m {
-		rv[k] = regexp.MustCompile(v)
-	}
-	return rv
-}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Conditions select the log lines a metric is computed from. All the
+// configured entries must hold for a line to be accepted; IfAny holds when
+// at least one of its groups does.
+type Conditions struct {
+	IfMatch    map[string]string `json:"if_match,omitempty"`
+	IfNotMatch map[string]string `json:"if_not_match,omitempty"`
+	IfCompare  map[string]string `json:"if_compare,omitempty"`
+	IfAny      []*Conditions     `json:"if_any,omitempty"`
+}
+
+type condition func(l map[string]string) bool
+
+func acceptAll(map[string]string) bool { return true }
+
+var compareOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+func makeComparison(field string, expr string) (condition, error) {
+	var e = strings.TrimSpace(expr)
+	for _, op := range compareOperators {
+		if !strings.HasPrefix(e, op) {
+			continue
+		}
+		ref, err := strconv.ParseFloat(strings.TrimSpace(e[len(op):]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number in %q", expr)
+		}
+		var test func(v float64) bool
+		switch op {
+		case ">=":
+			test = func(v float64) bool { return v >= ref }
+		case "<=":
+			test = func(v float64) bool { return v <= ref }
+		case "==":
+			test = func(v float64) bool { return v == ref }
+		case "!=":
+			test = func(v float64) bool { return v != ref }
+		case ">":
+			test = func(v float64) bool { return v > ref }
+		case "<":
+			test = func(v float64) bool { return v < ref }
+		}
+		return func(l map[string]string) bool {
+			v, err := strconv.ParseFloat(strings.TrimSpace(l[field]), 64)
+			return err == nil && test(v)
+		}, nil
+	}
+	return nil, fmt.Errorf("expected one of %s followed by a number, got %q", strings.Join(compareOperators, " "), expr)
+}
+
+func makeCondition(c *Conditions) (condition, error) {
+	if c == nil {
+		return acceptAll, nil
+	}
+	var all = []condition{}
+	for k, v := range c.IfMatch {
+		var field = k
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("if_match: %s: %v", k, err)
+		}
+		all = append(all, func(l map[string]string) bool { return re.MatchString(l[field]) })
+	}
+	for k, v := range c.IfNotMatch {
+		var field = k
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("if_not_match: %s: %v", k, err)
+		}
+		all = append(all, func(l map[string]string) bool { return !re.MatchString(l[field]) })
+	}
+	for k, v := range c.IfCompare {
+		cmp, err := makeComparison(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("if_compare: %s: %v", k, err)
+		}
+		all = append(all, cmp)
+	}
+	if len(c.IfAny) > 0 {
+		var any = make([]condition, 0, len(c.IfAny))
+		for i, g := range c.IfAny {
+			cond, err := makeCondition(g)
+			if err != nil {
+				return nil, fmt.Errorf("if_any[%d]: %v", i, err)
+			}
+			any = append(any, cond)
+		}
+		all = append(all, func(l map[string]string) bool {
+			for _, cond := range any {
+				if cond(l) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if len(all) == 0 {
+		return acceptAll, nil
+	}
+	return func(l map[string]string) bool {
+		for _, cond := range all {
+			if !cond(l) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gaugeTracker keeps the running max/min of every label combination of a
+// GaugeVec, restarting from the next observed value once resetInterval has
+// elapsed. The series with no new value within resetInterval are deleted by
+// expire.
+type gaugeTracker struct {
+	gauge         *prometheus.GaugeVec
+	mode          string
+	resetInterval time.Duration
+	values        map[string]*gaugeValue
+	lock          sync.Mutex
+}
+
+type gaugeValue struct {
+	labelValues map[string]string
+	value       float64
+	since       time.Time
+}
+
+func gaugeMode(c *MetricConfig) (string, error) {
+	switch c.GaugeMode {
+	case "", "set", "last":
+		return "last", nil
+	case "max", "min":
+		return c.GaugeMode, nil
+	}
+	return "", fmt.Errorf("unsupported gauge_mode %q", c.GaugeMode)
+}
+
+func newGaugeTracker(gauge *prometheus.GaugeVec, c *MetricConfig) (*gaugeTracker, error) {
+	mode, err := gaugeMode(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.ResetInterval < 0 {
+		return nil, fmt.Errorf("reset_interval must not be negative")
+	}
+	return &gaugeTracker{
+		gauge:         gauge,
+		mode:          mode,
+		resetInterval: time.Duration(c.ResetInterval) * time.Second,
+		values:        map[string]*gaugeValue{},
+	}, nil
+}
+
+func labelKey(labelValues map[string]string) string {
+	var names = make([]string, 0, len(labelValues))
+	for k := range labelValues {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		b.WriteString("#" + k + "#" + labelValues[k])
+	}
+	return b.String()
+}
+
+func (g *gaugeTracker) observe(labelValues map[string]string, v float64, now time.Time) {
+	if g.mode == "last" {
+		g.gauge.With(labelValues).Set(v)
+		return
+	}
+	var k = labelKey(labelValues)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	var e, ok = g.values[k]
+	if !ok || (g.resetInterval > 0 && now.Sub(e.since) >= g.resetInterval) {
+		e = &gaugeValue{labelValues, v, now}
+		g.values[k] = e
+	} else if (g.mode == "max" && v > e.value) || (g.mode == "min" && v < e.value) {
+		e.value = v
+	}
+	g.gauge.With(labelValues).Set(e.value)
+}
+
+// expire deletes the max/min series that started before reftime minus the
+// reset interval.
+func (g *gaugeTracker) expire(reftime time.Time) {
+	if g.resetInterval <= 0 {
+		return
+	}
+	var oldestBound = reftime.Add(-g.resetInterval)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for k, e := range g.values {
+		if e.since.Before(oldestBound) {
+			g.gauge.Delete(e.labelValues)
+			delete(g.values, k)
+		}
+	}
+}
+
+func (g *gaugeTracker) delete(labelValues map[string]string) {
+	g.lock.Lock()
+	delete(g.values, labelKey(labelValues))
+	g.lock.Unlock()
+	g.gauge.Delete(labelValues)
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// LabelSource describes how a label value is computed from a log line. In
+// the config it is either the name of a field, copied verbatim, or an object
+// with the field and the transforms to apply, in this order: regex, lowercase,
+// status_class, map, default.
+type LabelSource struct {
+	Field       string            `json:"field"`
+	Regex       string            `json:"regex,omitempty"`
+	Lowercase   bool              `json:"lowercase,omitempty"`
+	StatusClass bool              `json:"status_class,omitempty"`
+	Map         map[string]string `json:"map,omitempty"`
+	Default     string            `json:"default,omitempty"`
+}
+
+type LabelMap map[string]*LabelSource
+
+func (s *LabelSource) UnmarshalJSON(data []byte) error {
+	var field string
+	if err := json.Unmarshal(data, &field); err == nil {
+		*s = LabelSource{Field: field}
+		return nil
+	}
+	type plain LabelSource
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+func (s LabelSource) MarshalJSON() ([]byte, error) {
+	if len(s.Regex) == 0 && !s.Lowercase && !s.StatusClass && s.Map == nil && len(s.Default) == 0 {
+		return json.Marshal(s.Field)
+	}
+	type plain LabelSource
+	return json.Marshal(plain(s))
+}
+
+type labelValueFunc func(l map[string]string) string
+
+func statusClass(v string) string {
+	if len(v) == 3 && v[0] >= '1' && v[0] <= '5' {
+		return v[:1] + "xx"
+	}
+	return v
+}
+
+func makeLabelValueFunc(s *LabelSource) (labelValueFunc, error) {
+	if s == nil {
+		return nil, fmt.Errorf("missing label source")
+	}
+	var field = s.Field
+	var re *regexp.Regexp
+	if len(s.Regex) > 0 {
+		var err error
+		re, err = regexp.Compile(s.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("regex: %v", err)
+		}
+	}
+	var lowercase = s.Lowercase
+	var bucketStatus = s.StatusClass
+	var lookup = s.Map
+	var def = s.Default
+	return func(l map[string]string) string {
+		var v = l[field]
+		if re != nil {
+			var m = re.FindStringSubmatch(v)
+			switch {
+			case m == nil:
+				v = ""
+			case len(m) > 1:
+				v = m[1]
+			default:
+				v = m[0]
+			}
+		}
+		if lowercase {
+			v = strings.ToLower(v)
+		}
+		if bucketStatus {
+			v = statusClass(v)
+		}
+		if mapped, ok := lookup[v]; ok {
+			v = mapped
+		}
+		if len(v) == 0 {
+			v = def
+		}
+		return v
+	}, nil
+}
+
+type labelValuesFunc func(l map[string]string) map[string]string
+
+func makeLabelValuesFunc(m LabelMap) (labelValuesFunc, error) {
+	var funcs = make(map[string]labelValueFunc, len(m))
+	for k, v := range m {
+		f, err := makeLabelValueFunc(v)
+		if err != nil {
+			return nil, fmt.Errorf("label_map: %s: %v", k, err)
+		}
+		funcs[k] = f
+	}
+	return func(l map[string]string) map[string]string {
+		var labelValues = make(map[string]string, len(funcs))
+		for k, f := range funcs {
+			labelValues[k] = f(l)
+		}
+		return labelValues
+	}, nil
+}
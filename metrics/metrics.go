@@ -1,100 +1,308 @@
 package metrics
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"reflect"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"mxmz.it/nginxmetrics/logging"
 )
 
 type MetricConfig struct {
-	Type        string            `json:"type,omitempty"`
-	ValueSource string            `json:"value_source,omitempty"`
-	LabelMap    map[string]string `json:"label_map,omitempty"`
-	IfMatch     map[string]string `json:"if_match,omitempty"`
+	Type               string                    `json:"type,omitempty"`
+	ValueSource        string                    `json:"value_source,omitempty"`
+	LabelMap           LabelMap                  `json:"label_map,omitempty"`
+	Buckets            []float64                 `json:"buckets,omitempty"`
+	LinearBuckets      *LinearBucketsConfig      `json:"linear_buckets,omitempty"`
+	ExponentialBuckets *ExponentialBucketsConfig `json:"exponential_buckets,omitempty"`
+	Objectives         map[string]float64        `json:"objectives,omitempty"`
+	MaxAge             *int                      `json:"max_age,omitempty"`
+	AgeBuckets         *int                      `json:"age_buckets,omitempty"`
+	GaugeMode          string                    `json:"gauge_mode,omitempty"`
+	ResetInterval      int                       `json:"reset_interval,omitempty"`
+	MaxSeries          int                       `json:"max_series,omitempty"`
+	SeriesTTL          int                       `json:"series_ttl,omitempty"`
+	ValueSplit         *ValueSplitConfig         `json:"value_split,omitempty"`
+	Conditions
 }
 
 type Metrics struct {
-	r       *prometheus.Registry
-	metrics []injectLineFunc
+	r             *prometheus.Registry
+	metrics       map[string]*metric
+	droppedSeries *prometheus.CounterVec
+	lock          sync.RWMutex
 }
 
-func NewMetrics(config map[string]*MetricConfig) *Metrics {
-	var metrics = []injectLineFunc{}
+type observeFunc func(labelValues map[string]string, value float64, t time.Time)
+
+// countsLines tells whether a metric adds 1 for every matching line
+// instead of reading its value from value_source.
+func countsLines(v *MetricConfig) bool {
+	return v.Type == "count" || (v.Type == "counter" && len(v.ValueSource) == 0)
+}
+
+func makeInjector(v *MetricConfig, observe observeFunc) (injectLineFunc, error) {
+	var valueSource = v.ValueSource
+	var accept, err = makeCondition(&v.Conditions)
+	if err != nil {
+		return nil, err
+	}
+	labelValuesOf, err := makeLabelValuesFunc(v.LabelMap)
+	if err != nil {
+		return nil, err
+	}
+	var countLines = countsLines(v)
+	var inject = func(l map[string]string, t time.Time) bool {
+		if !accept(l) {
+			return false
+		}
+		var c float64 = 1
+		var err error
+		if !countLines {
+			c, err = strconv.ParseFloat(l[valueSource], 64)
+		}
+		if err != nil {
+			return false
+		}
+		observe(labelValuesOf(l), c, t)
+		return true
+	}
+	var split = makeLineSplitter(v)
+	if split == nil {
+		return inject, nil
+	}
+	return func(l map[string]string, t time.Time) bool {
+		var used = false
+		for _, sl := range split(l) {
+			used = inject(sl, t) || used
+		}
+		return used
+	}, nil
+}
+
+// metric is a configured metric: its collector, the function feeding it
+// log lines and, when max_series or series_ttl are set, its series tracker.
+type metric struct {
+	config    *MetricConfig
+	collector prometheus.Collector
+	inject    injectLineFunc
+	tracker   *seriesTracker
+	gauge     *gaugeTracker
+}
+
+// reservedLabels are the label names client_golang uses for the buckets of
+// histograms and the quantiles of summaries.
+var reservedLabels = map[string]string{"histogram": "le", "summary": "quantile"}
+
+func newMetric(name string, v *MetricConfig, droppedSeries *prometheus.CounterVec) (*metric, error) {
+	if reserved, ok := reservedLabels[v.Type]; ok {
+		if _, ok := v.LabelMap[reserved]; ok {
+			return nil, fmt.Errorf("%s: label name %q is reserved in %ss", name, reserved, v.Type)
+		}
+	}
+	var observe observeFunc
+	var gaugeTracker *gaugeTracker
+	var deleteSeries func(labelValues map[string]string)
+	var collector prometheus.Collector
+	switch v.Type {
+	case "counter", "count":
+		{
+			counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: name,
+				Help: name,
+			}, keys(v.LabelMap))
+			collector = counter
+			deleteSeries = func(labelValues map[string]string) { counter.Delete(labelValues) }
+			observe = func(labelValues map[string]string, c float64, t time.Time) {
+				counter.With(labelValues).Add(c)
+			}
+		}
+
+	case "summary":
+		{
+			objectives, err := summaryObjectives(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			maxAge, err := summaryMaxAge(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			ageBuckets, err := summaryAgeBuckets(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			counter := prometheus.NewSummaryVec(prometheus.SummaryOpts{
+				Name:       name,
+				Help:       name,
+				MaxAge:     maxAge,
+				AgeBuckets: ageBuckets,
+				Objectives: objectives,
+			}, keys(v.LabelMap))
+			collector = counter
+			deleteSeries = func(labelValues map[string]string) { counter.Delete(labelValues) }
+			observe = func(labelValues map[string]string, c float64, t time.Time) {
+				counter.With(labelValues).Observe(c)
+			}
+		}
+
+	case "histogram":
+		{
+			buckets, err := histogramBuckets(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    name,
+				Help:    name,
+				Buckets: buckets,
+			}, keys(v.LabelMap))
+			collector = histogram
+			deleteSeries = func(labelValues map[string]string) { histogram.Delete(labelValues) }
+			observe = func(labelValues map[string]string, c float64, t time.Time) {
+				histogram.With(labelValues).Observe(c)
+			}
+		}
+
+	case "gauge":
+		{
+			gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: name,
+				Help: name,
+			}, keys(v.LabelMap))
+			collector = gauge
+			tracker, err := newGaugeTracker(gauge, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			observe = func(labelValues map[string]string, c float64, t time.Time) {
+				tracker.observe(labelValues, c, t)
+			}
+			deleteSeries = tracker.delete
+			gaugeTracker = tracker
+		}
+
+	default:
+		return nil, fmt.Errorf("%s: unsupported metric type %q", name, v.Type)
+	}
+	if v.MaxSeries < 0 {
+		return nil, fmt.Errorf("%s: max_series must not be negative", name)
+	}
+	if v.SeriesTTL < 0 {
+		return nil, fmt.Errorf("%s: series_ttl must not be negative", name)
+	}
+	var tracker *seriesTracker
+	if v.MaxSeries > 0 || v.SeriesTTL > 0 {
+		tracker = newSeriesTracker(name, v.MaxSeries, time.Duration(v.SeriesTTL)*time.Second,
+			droppedSeries.WithLabelValues(name), deleteSeries)
+		var record = observe
+		observe = func(labelValues map[string]string, c float64, t time.Time) {
+			record(tracker.admit(labelValues, t), c, t)
+		}
+	}
+	injector, err := makeInjector(v, observe)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return &metric{v, collector, injector, tracker, gaugeTracker}, nil
+}
+
+func NewMetrics(config map[string]*MetricConfig) (*Metrics, error) {
 	var r = prometheus.NewRegistry()
 	r.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	var droppedSeries = promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+		Name: "nginxmetrics_series_dropped_total",
+		Help: "Label combinations folded into the overflow series because of max_series.",
+	}, []string{"metric"})
 
+	var m = &Metrics{r: r, metrics: map[string]*metric{}, droppedSeries: droppedSeries}
 	for k, v := range config {
 		var name = k
-		var labelMap = v.LabelMap
-		var valueSource = v.ValueSource
-		var ifMatch = makeIfMatchMap(v.IfMatch)
-		switch v.Type {
-		case "counter":
-			{
-				counter := promauto.With(r).NewCounterVec(prometheus.CounterOpts{
-					Name: name,
-					Help: name,
-				}, keys(v.LabelMap))
-				metrics = append(metrics, func(l map[string]string) {
-					for k, v := range ifMatch {
-						if !v.MatchString(l[k]) {
-							return
-						}
-					}
-					c, err := strconv.ParseFloat(l[valueSource], 64)
-					if err == nil {
-						var labelValues = map[string]string{}
-						for k, v := range labelMap {
-							labelValues[k] = l[v]
-						}
-						counter.With(labelValues).Add(float64(c))
-					}
-				})
-			}
+		var mt, err = newMetric(name, v, droppedSeries)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.Register(mt.collector); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		m.metrics[name] = mt
+	}
 
-		case "summary":
-			{
-				counter := promauto.With(r).NewSummaryVec(prometheus.SummaryOpts{
-					Name:       name,
-					Help:       name,
-					MaxAge:     10 * time.Minute,
-					Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
-				}, keys(v.LabelMap))
-				metrics = append(metrics, func(l map[string]string) {
-					for k, v := range ifMatch {
-						if !v.MatchString(l[k]) {
-							return
-						}
-					}
-					c, err := strconv.ParseFloat(l[valueSource], 64)
-					if err == nil {
-						var labelValues = map[string]string{}
-						for k, v := range labelMap {
-							labelValues[k] = l[v]
-						}
-						counter.With(labelValues).Observe(float64(c))
-					}
-				})
-			}
+	return m, nil
+}
 
-		default:
-			panic("Unsupporter metric type")
+// PrepareReload builds the metrics of a new config, keeping the state of
+// the ones whose definition did not change. Nothing is changed until the
+// returned commit function is called.
+func (m *Metrics) PrepareReload(config map[string]*MetricConfig) (commit func(), err error) {
+	var current = m.current()
+	var next = make(map[string]*metric, len(config))
+	var check = prometheus.NewRegistry()
+	check.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	check.MustRegister(m.droppedSeries)
+	for k, v := range config {
+		var name = k
+		var mt, ok = current[name]
+		if !ok || !reflect.DeepEqual(mt.config, v) {
+			mt, err = newMetric(name, v, m.droppedSeries)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := check.Register(mt.collector); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
 		}
+		next[name] = mt
 	}
 
-	return &Metrics{r, metrics}
+	return func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		for name, mt := range m.metrics {
+			if n, ok := next[name]; !ok || n != mt {
+				m.r.Unregister(mt.collector)
+				logging.Infof("metric %s removed", name)
+			}
+			// a changed metric keeps counting its dropped series
+			if _, ok := next[name]; !ok {
+				m.droppedSeries.DeleteLabelValues(name)
+			}
+		}
+		for name, mt := range next {
+			if o, ok := m.metrics[name]; !ok || o != mt {
+				m.r.MustRegister(mt.collector)
+				logging.Infof("metric %s added", name)
+			}
+		}
+		m.metrics = next
+	}, nil
+}
+
+func (m *Metrics) current() map[string]*metric {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.metrics
 }
 
 func (m *Metrics) HandleLogLine(line map[string]string) {
+	m.HandleLogLineAt(line, time.Now())
+}
 
-	for _, v := range m.metrics {
-		v(line)
+// HandleLogLineAt feeds a line logged at t to every metric and tells
+// whether any of them used it.
+func (m *Metrics) HandleLogLineAt(line map[string]string, t time.Time) bool {
+	var used = false
+	for _, v := range m.current() {
+		used = v.inject(line, t) || used
 	}
+	return used
 
 	// 	bytes_sent, err := strconv.Atoi(line["body_bytes_sent"])
 	// 	if err == nil {
@@ -122,14 +330,58 @@ func (m *Metrics) HandleLogLine(line map[string]string) {
 	// 	}
 }
 
+// Purge deletes the series of the metrics with a series_ttl that have not
+// been updated since timeref minus the ttl, and the max/min gauges with no
+// new value within their reset_interval.
+func (m *Metrics) Purge(timeref time.Time) {
+	for _, v := range m.current() {
+		if v.tracker != nil {
+			v.tracker.expire(timeref)
+		}
+		if v.gauge != nil {
+			v.gauge.expire(timeref)
+		}
+	}
+}
+
+func (m *Metrics) Gatherer() prometheus.Gatherer {
+	return m.r
+}
+
 func (m *Metrics) HttpHandler() http.Handler {
 	return promhttp.HandlerFor(m.r, promhttp.HandlerOpts{})
 }
 
+// StringizeMap flattens a decoded JSON object into fields: nested objects
+// and arrays become dotted keys (geo.country, tags.0), numbers keep their
+// decimal form and null is empty.
 func StringizeMap(in map[string]interface{}) map[string]string {
 	var out = make(map[string]string, len(in))
 	for k, v := range in {
-		out[k] = fmt.Sprint(v)
+		flatten(out, k, v)
 	}
 	return out
 }
+
+func flatten(out map[string]string, key string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, v := range v {
+			flatten(out, key+"."+k, v)
+		}
+	case []interface{}:
+		for i, v := range v {
+			flatten(out, key+"."+strconv.Itoa(i), v)
+		}
+	case nil:
+		out[key] = ""
+	case string:
+		out[key] = v
+	case json.Number:
+		out[key] = v.String()
+	case float64:
+		out[key] = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		out[key] = fmt.Sprint(v)
+	}
+}
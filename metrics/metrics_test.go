@@ -9,6 +9,9 @@ import (
 	"time"
 
 	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var config1 = `
@@ -93,7 +96,10 @@ func TestMetrics_HandleLogLine(t *testing.T) {
 
 	var config Config
 	json.Unmarshal([]byte(config1), &config)
-	var m = NewMetrics(config.Metrics)
+	var m, err = NewMetrics(config.Metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for _, line := range lines {
 		var lineMap map[string]string
@@ -121,7 +127,10 @@ func TestMetrics_HandleLogLine1(t *testing.T) {
 
 	var config Config
 	json.Unmarshal([]byte(config1), &config)
-	var m = NewMetrics(config.Metrics)
+	var m, err = NewMetrics(config.Metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for _, line := range lines {
 		var lineMap map[string]interface{}
@@ -151,9 +160,12 @@ func TestUniqueValueMetrics_HandleLogLine(t *testing.T) {
 
 	var config Config
 	json.Unmarshal([]byte(config1), &config)
-	var m = NewUniqueValueMetrics(config.Unique, func(name string, k string, labels map[string]string, rate float64) {
+	var m, err = NewUniqueValueMetrics(config.Unique, func(name string, k string, labels map[string]string, rate float64) {
 		fmt.Printf("%s: %s %v %v\n", name, k, labels, rate)
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for _, line := range lines {
 		var lineMap map[string]string
@@ -184,3 +196,635 @@ func TestUniqueValueMetrics_HandleLogLine(t *testing.T) {
 
 const sample = `
 {"@timestamp":"2021-06-07T07:01:00+02:00","remote_addr":"79.53.93.15 ","remote_user":"","auth_times":"0.000 0.004 0.004","auth_addr":"172.27.193.20:9470","method":"GET","uri":"/Issues/Tickets/Create?return_to=/redirect/areaclienti/TechnicalPanel/ConnectivityView.aspx&TICKET_TYPE=TICKET_TYPE_EXTERNAL&PROBLEM_TYPE=INCIDENT&SCOPE=SCOPE_ASSURANCE&SERVIZIO=XDSL&REMEDY_SERVICE=CI-571532-887392&ORARI_DIPONIB=09:00%2013:00%20-%2014:00%2018:00&REFERENTE_TECNICO=&LINE_FTTH=&EMAIL_REF_TEC=&TEL_REF_TEC=&OPENER_NAME=FUSI&OPENER_SURNAME=PAOLO","status": "200","body_bytes_sent":"170","request_time":0.002,"http_referrer":"","backend_addr":"","backend_status":"","backend_response_time":"","vhost":"https://troubleticket-reseller-areaclienti.irideos.it","jwt_exp":"","user_agent":"Mozilla/5.0 (Windows NT 6.3; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.77 Safari/537.36","request_length":1554}`
+
+var histogramConfig = `
+{
+	"metrics": {
+		"request_time": {
+			"value_source": "request_time",
+			"type":        "histogram",
+			"label_map": {
+				"vhost":  "vhost"
+			},
+			"buckets": [0.01, 0.1, 1]
+		},
+		"request_time_linear": {
+			"value_source": "request_time",
+			"type":        "histogram",
+			"linear_buckets": { "start": 0.5, "width": 0.5, "count": 4 }
+		},
+		"request_time_exp": {
+			"value_source": "request_time",
+			"type":        "histogram",
+			"exponential_buckets": { "start": 0.001, "factor": 10, "count": 4 }
+		}
+	}
+}`
+
+func TestMetrics_Histogram(t *testing.T) {
+	var config Config
+	if err := json.Unmarshal([]byte(histogramConfig), &config); err != nil {
+		t.Fatal(err)
+	}
+	var m, err = NewMetrics(config.Metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []string{"0.002", "0.05", "0.5", "3"} {
+		m.HandleLogLine(map[string]string{"vhost": "a", "request_time": v})
+	}
+
+	var families, _ = m.r.Gather()
+	var buckets = map[string]int{}
+	for _, f := range families {
+		if f.GetMetric()[0].Histogram == nil {
+			continue
+		}
+		var h = f.GetMetric()[0].Histogram
+		if h.GetSampleCount() != 4 {
+			t.Errorf("%s: sample count = %d", f.GetName(), h.GetSampleCount())
+		}
+		buckets[f.GetName()] = len(h.Bucket)
+		if f.GetName() == "request_time" {
+			var expected = []uint64{1, 2, 3}
+			for i, b := range h.Bucket {
+				if b.GetCumulativeCount() != expected[i] {
+					t.Errorf("bucket %v: count = %d, expected %d", b.GetUpperBound(), b.GetCumulativeCount(), expected[i])
+				}
+			}
+		}
+	}
+	if buckets["request_time"] != 3 || buckets["request_time_linear"] != 4 || buckets["request_time_exp"] != 4 {
+		t.Errorf("unexpected buckets: %v", buckets)
+	}
+}
+
+func TestHistogramBuckets_Invalid(t *testing.T) {
+	var invalid = []*MetricConfig{
+		{Buckets: []float64{1, 0.5}},
+		{LinearBuckets: &LinearBucketsConfig{Start: 0, Width: 1, Count: 0}},
+		{ExponentialBuckets: &ExponentialBucketsConfig{Start: 1, Factor: 1, Count: 3}},
+		{Buckets: []float64{1}, LinearBuckets: &LinearBucketsConfig{Start: 0, Width: 1, Count: 1}},
+	}
+	for _, c := range invalid {
+		if _, err := histogramBuckets(c); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
+
+func TestMetrics_SummaryOptions(t *testing.T) {
+	var maxAge = 3600
+	var ageBuckets = 3
+	var m, err = NewMetrics(map[string]*MetricConfig{
+		"request_time": {
+			Type:        "summary",
+			ValueSource: "request_time",
+			Objectives:  map[string]float64{"0.95": 0.005, "0.999": 0.0001},
+			MaxAge:      &maxAge,
+			AgeBuckets:  &ageBuckets,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.HandleLogLine(map[string]string{"request_time": "0.5"})
+
+	var families, _ = m.r.Gather()
+	for _, f := range families {
+		if f.GetName() != "request_time" {
+			continue
+		}
+		var quantiles = f.GetMetric()[0].Summary.Quantile
+		if len(quantiles) != 2 || quantiles[0].GetQuantile() != 0.95 || quantiles[1].GetQuantile() != 0.999 {
+			t.Errorf("unexpected quantiles: %v", quantiles)
+		}
+	}
+
+	var invalid = []*MetricConfig{
+		{Type: "summary", Objectives: map[string]float64{"p95": 0.01}},
+		{Type: "summary", Objectives: map[string]float64{"1.5": 0.01}},
+		{Type: "summary", Objectives: map[string]float64{"0.5": -1}},
+		{Type: "summary", MaxAge: new(int)},
+		{Type: "summary", AgeBuckets: new(int)},
+		{Type: "gauge_typo"},
+	}
+	for _, c := range invalid {
+		if _, err := NewMetrics(map[string]*MetricConfig{"x": c}); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
+
+func TestMetrics_CountLines(t *testing.T) {
+	var m, err = NewMetrics(map[string]*MetricConfig{
+		"requests_total": {
+			Type:     "count",
+			LabelMap: LabelMap{"vhost": {Field: "vhost"}, "status": {Field: "status"}},
+		},
+		"requests_no_source_total": {
+			Type:       "counter",
+			LabelMap:   LabelMap{"vhost": {Field: "vhost"}},
+			Conditions: Conditions{IfMatch: map[string]string{"status": "^5"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range []string{"200", "200", "502"} {
+		m.HandleLogLine(map[string]string{"vhost": "a", "status": status})
+	}
+
+	var families, _ = m.r.Gather()
+	var totals = map[string]float64{}
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			if metric.Counter != nil {
+				totals[f.GetName()] += metric.Counter.GetValue()
+			}
+		}
+	}
+	if totals["requests_total"] != 3 || totals["requests_no_source_total"] != 1 {
+		t.Errorf("unexpected totals: %v", totals)
+	}
+}
+
+func TestGaugeTracker(t *testing.T) {
+	var gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "queue"}, []string{"vhost"})
+	var tracker, err = newGaugeTracker(gauge, &MetricConfig{GaugeMode: "max", ResetInterval: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var labels = map[string]string{"vhost": "a"}
+	var t0 = time.Now()
+	var steps = []struct {
+		value    float64
+		at       time.Duration
+		expected float64
+	}{
+		{3, 0, 3},
+		{7, 10 * time.Second, 7},
+		{5, 20 * time.Second, 7},
+		{2, 61 * time.Second, 2},
+		{4, 70 * time.Second, 4},
+	}
+	for _, s := range steps {
+		tracker.observe(labels, s.value, t0.Add(s.at))
+		if v := testutil.ToFloat64(gauge.With(labels)); v != s.expected {
+			t.Errorf("at %v: gauge = %v, expected %v", s.at, v, s.expected)
+		}
+	}
+	// no new value after the one starting the interval at 61s
+	tracker.expire(t0.Add(120 * time.Second))
+	if n := testutil.CollectAndCount(gauge); n != 1 {
+		t.Errorf("%d series before the reset interval elapsed", n)
+	}
+	tracker.expire(t0.Add(122 * time.Second))
+	if n := testutil.CollectAndCount(gauge); n != 0 {
+		t.Errorf("%d series after the reset interval elapsed", n)
+	}
+
+	if _, err := newGaugeTracker(gauge, &MetricConfig{GaugeMode: "avg"}); err == nil {
+		t.Error("expected error for unsupported gauge_mode")
+	}
+}
+
+func TestMakeCondition(t *testing.T) {
+	var c Conditions
+	var err = json.Unmarshal([]byte(`{
+		"if_not_match": { "uri": "^/health" },
+		"if_any": [
+			{ "if_compare": { "status": ">= 500" } },
+			{ "if_compare": { "request_time": "> 1.0" } }
+		]
+	}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accept, err := makeCondition(&c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		line     map[string]string
+		expected bool
+	}{
+		{map[string]string{"uri": "/", "status": "502", "request_time": "0.1"}, true},
+		{map[string]string{"uri": "/", "status": "200", "request_time": "1.5"}, true},
+		{map[string]string{"uri": "/", "status": "200", "request_time": "0.1"}, false},
+		{map[string]string{"uri": "/healthz", "status": "503", "request_time": "0.1"}, false},
+		{map[string]string{"uri": "/", "status": "-", "request_time": "-"}, false},
+	}
+	for _, c := range cases {
+		if accept(c.line) != c.expected {
+			t.Errorf("%v: expected %v", c.line, c.expected)
+		}
+	}
+
+	for _, invalid := range []*Conditions{
+		{IfMatch: map[string]string{"uri": "("}},
+		{IfNotMatch: map[string]string{"uri": "["}},
+		{IfCompare: map[string]string{"status": "~ 500"}},
+		{IfCompare: map[string]string{"status": ">= five"}},
+		{IfAny: []*Conditions{{IfCompare: map[string]string{"status": "500"}}}},
+	} {
+		if _, err := makeCondition(invalid); err == nil {
+			t.Errorf("expected error for %+v", invalid)
+		}
+	}
+}
+
+func TestLabelMap_Transforms(t *testing.T) {
+	var labelMap LabelMap
+	var err = json.Unmarshal([]byte(`{
+		"vhost": "vhost",
+		"section": { "field": "uri", "regex": "^/([^/?]+)", "default": "root" },
+		"method": { "field": "method", "lowercase": true },
+		"status": { "field": "status", "status_class": true },
+		"backend": { "field": "backend_addr", "map": { "10.0.0.1:80": "web1", "10.0.0.2:80": "web2" }, "default": "none" }
+	}`), &labelMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labelValuesOf, err := makeLabelValuesFunc(labelMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		line     map[string]string
+		expected map[string]string
+	}{
+		{
+			map[string]string{"vhost": "a", "uri": "/api/v1/users?id=1", "method": "GET", "status": "404", "backend_addr": "10.0.0.2:80"},
+			map[string]string{"vhost": "a", "section": "api", "method": "get", "status": "4xx", "backend": "web2"},
+		},
+		{
+			map[string]string{"vhost": "b", "uri": "/", "method": "POST", "status": "-", "backend_addr": ""},
+			map[string]string{"vhost": "b", "section": "root", "method": "post", "status": "-", "backend": "none"},
+		},
+	}
+	for _, c := range cases {
+		var labelValues = labelValuesOf(c.line)
+		for k, v := range c.expected {
+			if labelValues[k] != v {
+				t.Errorf("%s = %q, expected %q", k, labelValues[k], v)
+			}
+		}
+	}
+
+	out, _ := json.Marshal(LabelMap{"vhost": {Field: "vhost"}})
+	if string(out) != `{"vhost":"vhost"}` {
+		t.Errorf("unexpected marshalled label_map: %s", out)
+	}
+	if _, err := makeLabelValuesFunc(LabelMap{"section": {Field: "uri", Regex: "("}}); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestMetrics_MaxSeries(t *testing.T) {
+	var m, err = NewMetrics(map[string]*MetricConfig{
+		"requests_total": {
+			Type:      "count",
+			LabelMap:  LabelMap{"vhost": {Field: "vhost"}},
+			MaxSeries: 2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vhost := range []string{"a", "b", "a", "c", "d", "c", "b"} {
+		m.HandleLogLine(map[string]string{"vhost": vhost})
+	}
+
+	var families, _ = m.r.Gather()
+	var values = map[string]float64{}
+	var dropped float64
+	for _, f := range families {
+		switch f.GetName() {
+		case "requests_total":
+			for _, metric := range f.GetMetric() {
+				values[metric.Label[0].GetValue()] = metric.Counter.GetValue()
+			}
+		case "nginxmetrics_series_dropped_total":
+			dropped = f.GetMetric()[0].Counter.GetValue()
+		}
+	}
+	if len(values) != 3 || values["a"] != 2 || values["b"] != 2 || values[overflowLabelValue] != 3 {
+		t.Errorf("unexpected series: %v", values)
+	}
+	// c is counted once
+	if dropped != 2 {
+		t.Errorf("dropped = %v, expected 2", dropped)
+	}
+}
+
+func TestMetrics_SeriesTTL(t *testing.T) {
+	var m, err = NewMetrics(map[string]*MetricConfig{
+		"requests_total": {
+			Type:      "count",
+			LabelMap:  LabelMap{"vhost": {Field: "vhost"}},
+			SeriesTTL: 60,
+		},
+		"request_time": {
+			Type:        "summary",
+			ValueSource: "request_time",
+			LabelMap:    LabelMap{"vhost": {Field: "vhost"}},
+			SeriesTTL:   60,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series = func() map[string]int {
+		var families, _ = m.r.Gather()
+		var rv = map[string]int{}
+		for _, f := range families {
+			rv[f.GetName()] = len(f.GetMetric())
+		}
+		return rv
+	}
+
+	var t0 = time.Now()
+	m.HandleLogLine(map[string]string{"vhost": "a", "request_time": "0.1"})
+	m.HandleLogLine(map[string]string{"vhost": "b", "request_time": "0.1"})
+	m.Purge(t0.Add(30 * time.Second))
+	if s := series(); s["requests_total"] != 2 || s["request_time"] != 2 {
+		t.Errorf("unexpected series before ttl: %v", s)
+	}
+	m.Purge(t0.Add(2 * time.Minute))
+	if s := series(); s["requests_total"] != 0 || s["request_time"] != 0 {
+		t.Errorf("unexpected series after ttl: %v", s)
+	}
+}
+
+func TestMetrics_ValueSplit(t *testing.T) {
+	var config Config
+	var err = json.Unmarshal([]byte(`{
+		"metrics": {
+			"upstream_response_time": {
+				"type": "histogram",
+				"value_source": "upstream_response_time",
+				"value_split": { "zip": ["upstream_addr", "upstream_status"] },
+				"label_map": { "upstream": "upstream_addr", "status": "upstream_status" }
+			},
+			"upstream_errors_total": {
+				"type": "count",
+				"value_split": { "zip": ["upstream_addr", "upstream_status"] },
+				"label_map": { "upstream": "upstream_addr" },
+				"if_compare": { "upstream_status": ">= 500" }
+			}
+		}
+	}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMetrics(config.Metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.HandleLogLine(map[string]string{
+		"upstream_response_time": "0.010, 0.020 : 0.003",
+		"upstream_addr":          "10.0.0.1:80, 10.0.0.2:80 : unix:/tmp/sock",
+		"upstream_status":        "502, 504 : 200",
+	})
+	m.HandleLogLine(map[string]string{
+		"upstream_response_time": "0.5",
+		"upstream_addr":          "10.0.0.1:80",
+		"upstream_status":        "200",
+	})
+
+	var families, _ = m.r.Gather()
+	var observations = map[string]uint64{}
+	var errors = map[string]float64{}
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			var labels = map[string]string{}
+			for _, l := range metric.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			switch f.GetName() {
+			case "upstream_response_time":
+				observations[labels["upstream"]+" "+labels["status"]] = metric.Histogram.GetSampleCount()
+			case "upstream_errors_total":
+				errors[labels["upstream"]] = metric.Counter.GetValue()
+			}
+		}
+	}
+	var expected = map[string]uint64{
+		"10.0.0.1:80 502":    1,
+		"10.0.0.2:80 504":    1,
+		"unix:/tmp/sock 200": 1,
+		"10.0.0.1:80 200":    1,
+	}
+	if len(observations) != len(expected) {
+		t.Errorf("unexpected observations: %v", observations)
+	}
+	for k, v := range expected {
+		if observations[k] != v {
+			t.Errorf("%s: %d observations, expected %d", k, observations[k], v)
+		}
+	}
+	if len(errors) != 2 || errors["10.0.0.1:80"] != 1 || errors["10.0.0.2:80"] != 1 {
+		t.Errorf("unexpected errors: %v", errors)
+	}
+}
+
+func TestMetrics_PrepareReload(t *testing.T) {
+	var config = map[string]*MetricConfig{
+		"requests_total": {Type: "count", LabelMap: LabelMap{"vhost": {Field: "vhost"}}},
+		"bytes_total":    {Type: "counter", ValueSource: "bytes"},
+		"old_total":      {Type: "count"},
+	}
+	var m, err = NewMetrics(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.HandleLogLine(map[string]string{"vhost": "a", "bytes": "10"})
+
+	var values = func() map[string]float64 {
+		var families, _ = m.r.Gather()
+		var rv = map[string]float64{}
+		for _, f := range families {
+			for _, metric := range f.GetMetric() {
+				if metric.Counter != nil {
+					rv[f.GetName()] += metric.Counter.GetValue()
+				}
+			}
+		}
+		return rv
+	}
+
+	var invalid = map[string]*MetricConfig{
+		"requests_total": {Type: "count", LabelMap: LabelMap{"vhost": {Field: "vhost"}}},
+		"bad":            {Type: "count", Conditions: Conditions{IfMatch: map[string]string{"uri": "("}}},
+	}
+	if _, err := m.PrepareReload(invalid); err == nil {
+		t.Error("expected error for invalid config")
+	}
+
+	commit, err := m.PrepareReload(map[string]*MetricConfig{
+		"requests_total": {Type: "count", LabelMap: LabelMap{"vhost": {Field: "vhost"}}},
+		"bytes_total":    {Type: "counter", ValueSource: "body_bytes_sent"},
+		"new_total":      {Type: "count"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := values(); v["old_total"] != 1 || v["new_total"] != 0 {
+		t.Errorf("config changed before commit: %v", v)
+	}
+	commit()
+	m.HandleLogLine(map[string]string{"vhost": "a", "body_bytes_sent": "5"})
+
+	var v = values()
+	if v["requests_total"] != 2 {
+		t.Errorf("requests_total = %v, expected the unchanged metric to keep its state", v["requests_total"])
+	}
+	if v["bytes_total"] != 5 {
+		t.Errorf("bytes_total = %v, expected the changed metric to restart", v["bytes_total"])
+	}
+	if _, ok := v["old_total"]; ok || v["new_total"] != 1 {
+		t.Errorf("unexpected metrics after reload: %v", v)
+	}
+}
+
+func TestMetrics_PrepareReload_MaxSeries(t *testing.T) {
+	var m, err = NewMetrics(map[string]*MetricConfig{
+		"requests_total": {Type: "count", LabelMap: LabelMap{"vhost": {Field: "vhost"}}, MaxSeries: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := m.PrepareReload(map[string]*MetricConfig{
+		"requests_total": {Type: "count", LabelMap: LabelMap{"vhost": {Field: "vhost"}}, MaxSeries: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit()
+	for _, vhost := range []string{"a", "b", "c", "d"} {
+		m.HandleLogLine(map[string]string{"vhost": vhost})
+	}
+	var dropped float64
+	var families, _ = m.r.Gather()
+	for _, f := range families {
+		if f.GetName() == "nginxmetrics_series_dropped_total" {
+			dropped = f.GetMetric()[0].Counter.GetValue()
+		}
+	}
+	if dropped != 2 {
+		t.Errorf("dropped = %v after the reload, expected 2", dropped)
+	}
+}
+
+func TestUniqueValueMetrics_PrepareReload(t *testing.T) {
+	var m, err = NewUniqueValueMetrics(map[string]*DistinctCounterConfig{
+		"users":  {ValueSource: "remote_addr", TimeWindow: 60},
+		"agents": {ValueSource: "user_agent", TimeWindow: 60},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.HandleLogLine(map[string]string{"remote_addr": "1.2.3.4", "user_agent": "curl"})
+
+	commit, err := m.PrepareReload(map[string]*DistinctCounterConfig{
+		"users":  {ValueSource: "remote_addr", TimeWindow: 60},
+		"agents": {ValueSource: "user_agent", TimeWindow: 120},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit()
+	m.HandleLogLine(map[string]string{"remote_addr": "5.6.7.8", "user_agent": "wget"})
+
+	var current = m.current()
+	if n := current["users"].counters.get("").Count(); n != 2 {
+		t.Errorf("users = %d, expected the unchanged counter to keep its values", n)
+	}
+	if n := current["agents"].counters.get("").Count(); n != 1 {
+		t.Errorf("agents = %d, expected the changed counter to restart", n)
+	}
+}
+
+func TestValidateMetrics(t *testing.T) {
+	var config Config
+	var err = json.Unmarshal([]byte(`{
+		"metrics": {
+			"nginx-requests": { "type": "count", "if_match": { "uri": "(" } },
+			"nginx_time": { "type": "summry", "value_source": "request_time", "label_map": { "geo": { "field": "geo.country", "regex": "[" } } },
+			"nginx_latency": { "type": "histogram", "buckets": [1, 0.5], "if_not_match": { "geo.country": "[" } },
+			"nginx_ok": { "type": "histogram", "value_source": "request_time", "label_map": { "vhost": "vhost" } },
+			"nginx_buckets": { "type": "histogram", "value_source": "request_time", "label_map": { "le": "vhost" } },
+			"nginx_quantiles": { "type": "summary", "value_source": "request_time", "label_map": { "quantile": "vhost", "le": "status" } }
+		},
+		"unique": {
+			"users": { "value_source": " , ", "time_window": 0, "label_map": { "__vhost": "vhost" } }
+		}
+	}`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{
+		`metrics.nginx_buckets.label_map.le`,
+		`metrics.nginx_latency.buckets`,
+		`metrics.nginx_latency.if_not_match["geo.country"]`,
+		`metrics.nginx_latency.value_source`,
+		`metrics.nginx_quantiles.label_map.quantile`,
+		`metrics.nginx_time.label_map.geo.regex`,
+		`metrics.nginx_time.type`,
+		`metrics["nginx-requests"]`,
+		`metrics["nginx-requests"].if_match.uri`,
+	}
+	var problems = ValidateMetrics(config.Metrics, "metrics")
+	if len(problems) != len(expected) {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	for i, p := range problems {
+		if p.Path != expected[i] {
+			t.Errorf("problem %d: path = %s, expected %s", i, p.Path, expected[i])
+		}
+	}
+
+	if _, err := NewMetrics(map[string]*MetricConfig{"nginx_buckets": config.Metrics["nginx_buckets"]}); err == nil {
+		t.Error("histogram with a le label accepted")
+	}
+
+	problems = ValidateUnique(config.Unique, "unique")
+	expected = []string{"unique.users.label_map.__vhost", "unique.users.time_window", "unique.users.value_source"}
+	if len(problems) != len(expected) {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+	for i, p := range problems {
+		if p.Path != expected[i] {
+			t.Errorf("problem %d: path = %s, expected %s", i, p.Path, expected[i])
+		}
+	}
+}
+
+func TestStringizeMap(t *testing.T) {
+	var lineMap map[string]interface{}
+	var decoder = json.NewDecoder(strings.NewReader(`{"status": 200, "bytes": 1000000, "rt": 0.000125, "geo": {"country": "IT", "loc": {"lat": 45.5}}, "tags": ["a", "b"], "jwt": null, "cached": true}`))
+	decoder.UseNumber()
+	if err := decoder.Decode(&lineMap); err != nil {
+		t.Fatal(err)
+	}
+	var expected = map[string]string{
+		"status": "200", "bytes": "1000000", "rt": "0.000125",
+		"geo.country": "IT", "geo.loc.lat": "45.5",
+		"tags.0": "a", "tags.1": "b",
+		"jwt": "", "cached": "true",
+	}
+	var l = StringizeMap(lineMap)
+	if len(l) != len(expected) {
+		t.Errorf("unexpected fields: %v", l)
+	}
+	for k, v := range expected {
+		if l[k] != v {
+			t.Errorf("%s = %q, expected %q", k, l[k], v)
+		}
+	}
+	if v := StringizeMap(map[string]interface{}{"bytes": float64(1000000)})["bytes"]; v != "1000000" {
+		t.Errorf("float64 formatted as %q", v)
+	}
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"mxmz.it/nginxmetrics/logging"
+)
+
+const overflowLabelValue = "__overflow__"
+
+// foldedLimit bounds the folded combinations remembered so that each is
+// counted once as dropped. When it is reached they are forgotten, and may be
+// counted again.
+const foldedLimit = 10000
+
+// seriesTracker keeps track of the label combinations of a metric so that
+// their number can be capped at maxSeries and the ones not updated within ttl
+// can be deleted. Combinations beyond the limit are folded into a single
+// series whose labels are all set to "__overflow__".
+type seriesTracker struct {
+	name         string
+	maxSeries    int
+	ttl          time.Duration
+	series       map[string]*seriesEntry
+	overflow     *seriesEntry
+	folded       map[string]struct{}
+	dropped      prometheus.Counter
+	deleteSeries func(labelValues map[string]string)
+	limitHit     bool
+	lock         sync.Mutex
+}
+
+type seriesEntry struct {
+	labelValues map[string]string
+	last        time.Time
+}
+
+func newSeriesTracker(name string, maxSeries int, ttl time.Duration, dropped prometheus.Counter, deleteSeries func(map[string]string)) *seriesTracker {
+	return &seriesTracker{
+		name:         name,
+		maxSeries:    maxSeries,
+		ttl:          ttl,
+		series:       map[string]*seriesEntry{},
+		folded:       map[string]struct{}{},
+		dropped:      dropped,
+		deleteSeries: deleteSeries,
+	}
+}
+
+func overflowLabels(labelValues map[string]string) map[string]string {
+	var rv = make(map[string]string, len(labelValues))
+	for k := range labelValues {
+		rv[k] = overflowLabelValue
+	}
+	return rv
+}
+
+// admit records an update of the series identified by labelValues and
+// returns the labels the value must be recorded with.
+func (s *seriesTracker) admit(labelValues map[string]string, now time.Time) map[string]string {
+	var k = labelKey(labelValues)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.series[k]; ok {
+		e.last = now
+		return labelValues
+	}
+	if s.maxSeries > 0 && len(s.series) >= s.maxSeries {
+		if !s.limitHit {
+			logging.Warnf("%s: max_series limit of %d reached, new label combinations go to the %s series", s.name, s.maxSeries, overflowLabelValue)
+			s.limitHit = true
+		}
+		if _, ok := s.folded[k]; !ok {
+			if len(s.folded) >= foldedLimit {
+				s.folded = map[string]struct{}{}
+			}
+			s.folded[k] = struct{}{}
+			s.dropped.Inc()
+		}
+		if s.overflow == nil {
+			s.overflow = &seriesEntry{overflowLabels(labelValues), now}
+		}
+		s.overflow.last = now
+		return s.overflow.labelValues
+	}
+	s.series[k] = &seriesEntry{labelValues, now}
+	return labelValues
+}
+
+func (s *seriesTracker) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.series)
+}
+
+// expire deletes the series not updated within the ttl before reftime.
+func (s *seriesTracker) expire(reftime time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+	var oldestBound = reftime.Add(-s.ttl)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, e := range s.series {
+		if e.last.Before(oldestBound) {
+			s.deleteSeries(e.labelValues)
+			delete(s.series, k)
+		}
+	}
+	if s.overflow != nil && s.overflow.last.Before(oldestBound) {
+		s.deleteSeries(s.overflow.labelValues)
+		s.overflow = nil
+		s.folded = map[string]struct{}{}
+	}
+	if len(s.series) < s.maxSeries {
+		s.limitHit = false
+	}
+}
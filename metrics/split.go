@@ -0,0 +1,62 @@
+package metrics
+
+import "strings"
+
+// ValueSplitConfig enables one observation per element of nginx upstream
+// lists such as "0.010, 0.020 : 0.003". The fields in Zip are split the same
+// way and their elements are matched by position, so they can be used in
+// label_map and conditions.
+type ValueSplitConfig struct {
+	Zip []string `json:"zip,omitempty"`
+}
+
+// splitUpstreamList splits the value of $upstream_* variables: servers of a
+// group are separated by commas, groups (after an internal redirect) by colons.
+func splitUpstreamList(v string) []string {
+	var rv = []string{}
+	for _, group := range strings.Split(v, " : ") {
+		for _, e := range strings.Split(group, ",") {
+			rv = append(rv, strings.TrimSpace(e))
+		}
+	}
+	return rv
+}
+
+type lineSplitter func(l map[string]string) []map[string]string
+
+func makeLineSplitter(v *MetricConfig) lineSplitter {
+	if v.ValueSplit == nil {
+		return nil
+	}
+	var fields = []string{}
+	if len(v.ValueSource) > 0 {
+		fields = append(fields, v.ValueSource)
+	}
+	fields = append(fields, v.ValueSplit.Zip...)
+	if len(fields) == 0 {
+		return nil
+	}
+	return func(l map[string]string) []map[string]string {
+		var elements = make(map[string][]string, len(fields))
+		for _, f := range fields {
+			elements[f] = splitUpstreamList(l[f])
+		}
+		var count = len(elements[fields[0]])
+		var rv = make([]map[string]string, 0, count)
+		for i := 0; i < count; i++ {
+			var sl = make(map[string]string, len(l))
+			for k, v := range l {
+				sl[k] = v
+			}
+			for _, f := range fields {
+				if i < len(elements[f]) {
+					sl[f] = elements[f][i]
+				} else {
+					sl[f] = ""
+				}
+			}
+			rv = append(rv, sl)
+		}
+		return rv
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var defaultSummaryObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+const defaultSummaryMaxAge = 10 * time.Minute
+
+// summaryObjectives parses the configured quantile -> allowed error map,
+// falling back to the default objectives when none is set.
+func summaryObjectives(c *MetricConfig) (map[float64]float64, error) {
+	if c.Objectives == nil {
+		return defaultSummaryObjectives, nil
+	}
+	var rv = make(map[float64]float64, len(c.Objectives))
+	for k, e := range c.Objectives {
+		q, err := strconv.ParseFloat(k, 64)
+		if err != nil || q <= 0 || q >= 1 {
+			return nil, fmt.Errorf("objectives: invalid quantile %q, must be a number between 0 and 1", k)
+		}
+		if e < 0 || e >= 1 {
+			return nil, fmt.Errorf("objectives: invalid error %v for quantile %q, must be between 0 and 1", e, k)
+		}
+		rv[q] = e
+	}
+	return rv, nil
+}
+
+func summaryMaxAge(c *MetricConfig) (time.Duration, error) {
+	if c.MaxAge == nil {
+		return defaultSummaryMaxAge, nil
+	}
+	if *c.MaxAge <= 0 {
+		return 0, fmt.Errorf("max_age must be positive")
+	}
+	return time.Duration(*c.MaxAge) * time.Second, nil
+}
+
+func summaryAgeBuckets(c *MetricConfig) (uint32, error) {
+	if c.AgeBuckets == nil {
+		return 0, nil
+	}
+	if *c.AgeBuckets <= 0 {
+		return 0, fmt.Errorf("age_buckets must be positive")
+	}
+	return uint32(*c.AgeBuckets), nil
+}
@@ -2,16 +2,17 @@ package metrics
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashicorp/golang-lru/simplelru"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"mxmz.it/nginxmetrics/logging"
 )
 
 type lruCache struct {
@@ -65,7 +66,7 @@ func (c *lruCache) PurgeOldestIf(pred func(cacheEntry) bool) {
 		}
 		if pred(e) {
 			c.remove(k)
-			log.Println(k)
+			logging.Debugf("expired %v", k)
 		} else {
 			break
 		}
@@ -97,11 +98,11 @@ func (c *lruCache) AddOrUpdate(k interface{}, add func() *cacheEntry, update fun
 }
 
 type DistinctCounterConfig struct {
-	ValueSource         string            `json:"value_source,omitempty"`
-	TimeWindow          int               `json:"time_window,omitempty"`
-	LabelMap            map[string]string `json:"label_map,omitempty"`
-	IfMatch             map[string]string `json:"if_match,omitempty"`
-	NotifyRateThreshold *float64          `json:"notify_rate_threshold,omitempty"`
+	ValueSource         string   `json:"value_source,omitempty"`
+	TimeWindow          int      `json:"time_window,omitempty"`
+	LabelMap            LabelMap `json:"label_map,omitempty"`
+	NotifyRateThreshold *float64 `json:"notify_rate_threshold,omitempty"`
+	Conditions
 }
 
 type gaugeSetter func(v float64)
@@ -188,7 +189,7 @@ func (cm *UniqueCounterMap) purge(reftime time.Time) {
 	var l = make([]*uniqueCounter, 0, len(cm.counters))
 	for k, v := range cm.counters {
 		l = append(l, v)
-		log.Printf("purging %s[%d]...\n", k, v.Count())
+		logging.Debugf("purging %s[%d]...", k, v.Count())
 	}
 	cm.lock.Unlock()
 	for _, v := range l {
@@ -227,73 +228,150 @@ func (cm *UniqueCounterMap) create(name string, timeWindow time.Duration, gauge
 	return rv
 }
 
+type notifyFunc func(name string, k string, labels map[string]string, rate float64)
+
 type UniqueValueMetrics struct {
-	r         *prometheus.Registry
-	ingestors []injectLineFunc
-	metrics   map[string]*UniqueCounterMap
+	r       *prometheus.Registry
+	notify  notifyFunc
+	metrics map[string]*uniqueMetric
+	lock    sync.RWMutex
+}
+
+type uniqueMetric struct {
+	config   *DistinctCounterConfig
+	gaugevec *prometheus.GaugeVec
+	counters *UniqueCounterMap
+	ingest   injectLineFunc
+}
+
+func newUniqueMetric(name string, v *DistinctCounterConfig, notify notifyFunc) (*uniqueMetric, error) {
+	var counters = &UniqueCounterMap{counters: map[string]*uniqueCounter{}}
+	var idSource = strings.Split(v.ValueSource, ",")
+	var accept, err = makeCondition(&v.Conditions)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	labelValuesOf, err := makeLabelValuesFunc(v.LabelMap)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	var notifyRateThreshold = v.NotifyRateThreshold
+	var timeWindow = time.Duration(v.TimeWindow) * time.Second
+	gaugevec := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: name,
+		Help: name,
+	}, keys(v.LabelMap))
+	ingestor := func(l map[string]string, t time.Time) bool {
+		if !accept(l) {
+			return false
+		}
+		id := ""
+		for _, v := range idSource {
+			id += "#" + strings.TrimSpace(l[v])
+		}
+		//id, ok := l[idSource]
+		if len(id) > len(idSource) {
+			//	fmt.Printf("id = %v\n", id)
+
+			var labelValues = labelValuesOf(l)
+			for k, v := range labelValues {
+				labelValues[k] = strings.TrimSpace(v)
+			}
+			var key = labelKey(labelValues)
+			uc := counters.get(key)
+			if uc == nil {
+				gauge := gaugevec.With(labelValues)
+				setGauge := func(v float64) { gauge.Set(v) }
+				uc = counters.create(key, timeWindow, setGauge)
+			}
+			var entry = uc.add(id, t)
+			if notifyRateThreshold != nil {
+				var dt = entry.last.Sub(entry.first)
+				if dt > 0 {
+					// log.Printf("count=%v dt=%v\n", entry.count, float64(dt)/float64(time.Second))
+					// log.Printf("j=%s l=%v\n", labelKey, l)
+					var rate = (float64(entry.count) / float64(dt)) * float64(time.Second)
+					if rate >= *notifyRateThreshold {
+						notify(name, id, labelValues, rate)
+					}
+				}
+			}
+			return true
+		}
+		return false
+	}
+	return &uniqueMetric{v, gaugevec, counters, ingestor}, nil
 }
 
-func NewUniqueValueMetrics(config map[string]*DistinctCounterConfig, notify func(name string, k string, labels map[string]string, rate float64)) *UniqueValueMetrics {
-	var metrics = map[string]*UniqueCounterMap{}
+func NewUniqueValueMetrics(config map[string]*DistinctCounterConfig, notify func(name string, k string, labels map[string]string, rate float64)) (*UniqueValueMetrics, error) {
 	var r = prometheus.NewRegistry()
 	r.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
 
-	var ingestors = []injectLineFunc{}
+	var m = &UniqueValueMetrics{r: r, notify: notify, metrics: map[string]*uniqueMetric{}}
 	for k, v := range config {
 		var name = k
-		var counters = &UniqueCounterMap{counters: map[string]*uniqueCounter{}}
-		metrics[name] = counters
-		var labelMap = v.LabelMap
-		var idSource = strings.Split(v.ValueSource, ",")
-		var ifMatch = makeIfMatchMap(v.IfMatch)
-		var notifyRateThreshold = v.NotifyRateThreshold
-		gaugevec := promauto.With(r).NewGaugeVec(prometheus.GaugeOpts{
-			Name: name,
-			Help: name,
-		}, keys(v.LabelMap))
-		ingestor := func(l map[string]string) {
-			for k, v := range ifMatch {
-				if !v.MatchString(l[k]) {
-					return
-				}
+		var um, err = newUniqueMetric(name, v, notify)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.Register(um.gaugevec); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		m.metrics[name] = um
+	}
+	return m, nil
+}
+
+// PrepareReload builds the unique counters of a new config, keeping the
+// ones whose definition did not change together with their LRU caches.
+// Nothing is changed until the returned commit function is called.
+func (m *UniqueValueMetrics) PrepareReload(config map[string]*DistinctCounterConfig) (commit func(), err error) {
+	var current = m.current()
+	var next = make(map[string]*uniqueMetric, len(config))
+	var check = prometheus.NewRegistry()
+	check.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	for k, v := range config {
+		var name = k
+		var um, ok = current[name]
+		if !ok || !reflect.DeepEqual(um.config, v) {
+			um, err = newUniqueMetric(name, v, m.notify)
+			if err != nil {
+				return nil, err
 			}
-			id := ""
-			for _, v := range idSource {
-				id += "#" + strings.TrimSpace(l[v])
+		}
+		if err := check.Register(um.gaugevec); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		next[name] = um
+	}
+
+	return func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		for name, um := range m.metrics {
+			if n, ok := next[name]; !ok || n != um {
+				m.r.Unregister(um.gaugevec)
+				logging.Infof("unique counter %s removed", name)
 			}
-			//id, ok := l[idSource]
-			if len(id) > len(idSource) {
-				//	fmt.Printf("id = %v\n", id)
-
-				var labelValues = map[string]string{}
-				var labelKey = ""
-				for k, v := range labelMap {
-					labelValues[k] = strings.TrimSpace(l[v])
-					labelKey += "#" + k + "#" + l[v]
-				}
-				uc := counters.get(labelKey)
-				if uc == nil {
-					gauge := gaugevec.With(labelValues)
-					setGauge := func(v float64) { gauge.Set(v) }
-					uc = counters.create(labelKey, time.Duration(v.TimeWindow)*time.Second, setGauge)
-				}
-				var entry = uc.add(id, time.Now())
-				if notifyRateThreshold != nil {
-					var dt = entry.last.Sub(entry.first)
-					if dt > 0 {
-						// log.Printf("count=%v dt=%v\n", entry.count, float64(dt)/float64(time.Second))
-						// log.Printf("j=%s l=%v\n", labelKey, l)
-						var rate = (float64(entry.count) / float64(dt)) * float64(time.Second)
-						if rate >= *notifyRateThreshold {
-							notify(name, id, labelValues, rate)
-						}
-					}
-				}
+		}
+		for name, um := range next {
+			if o, ok := m.metrics[name]; !ok || o != um {
+				m.r.MustRegister(um.gaugevec)
+				logging.Infof("unique counter %s added", name)
 			}
 		}
-		ingestors = append(ingestors, ingestor)
-	}
-	return &UniqueValueMetrics{r, ingestors, metrics}
+		m.metrics = next
+	}, nil
+}
+
+func (m *UniqueValueMetrics) current() map[string]*uniqueMetric {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.metrics
+}
+
+func (m *UniqueValueMetrics) Gatherer() prometheus.Gatherer {
+	return m.r
 }
 
 func (m *UniqueValueMetrics) HttpHandler() http.Handler {
@@ -301,15 +379,22 @@ func (m *UniqueValueMetrics) HttpHandler() http.Handler {
 }
 
 func (m *UniqueValueMetrics) HandleLogLine(line map[string]string) {
+	m.HandleLogLineAt(line, time.Now())
+}
 
-	for _, v := range m.ingestors {
-		v(line)
+// HandleLogLineAt feeds a line logged at t to every unique counter and
+// tells whether any of them used it.
+func (m *UniqueValueMetrics) HandleLogLineAt(line map[string]string, t time.Time) bool {
+	var used = false
+	for _, v := range m.current() {
+		used = v.ingest(line, t) || used
 	}
+	return used
 }
 
 func (m *UniqueValueMetrics) Purge(timeref time.Time) {
-	for _, v := range m.metrics {
-		v.purge(timeref)
+	for _, v := range m.current() {
+		v.counters.purge(timeref)
 	}
 }
 
@@ -323,10 +408,11 @@ func (uvm *UniqueValueMetrics) InspectHttpHandler() http.Handler {
 	return http.HandlerFunc(func(rsp http.ResponseWriter, r *http.Request) {
 		var filter = r.URL.Query().Get("metric")
 		var out = map[string]interface{}{}
-		for k, m := range uvm.metrics {
+		for k, um := range uvm.current() {
 			if len(filter) > 0 && k != filter {
 				continue
 			}
+			var m = um.counters
 
 			var ks = m.keys()
 			var rv = map[string]map[string]inspectData{}
@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ValidationError is a problem found in the config, located by a path like
+// metrics.nginx_request_time.if_match.uri.
+type ValidationError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) Error() string {
+	return e.Path + ": " + e.Message
+}
+
+type ValidationErrors []ValidationError
+
+func (es ValidationErrors) Error() string {
+	var l = make([]string, 0, len(es))
+	for _, e := range es {
+		l = append(l, e.Error())
+	}
+	return strings.Join(l, "; ")
+}
+
+var (
+	metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRe  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	pathKeyRe    = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+)
+
+// JoinPath appends a key to a config path, quoting keys that are not plain
+// identifiers (e.g. flattened fields like geo.country).
+func JoinPath(path string, key string) string {
+	if !pathKeyRe.MatchString(key) {
+		key = fmt.Sprintf("[%q]", key)
+	} else if len(path) > 0 {
+		key = "." + key
+	}
+	return path + key
+}
+
+func sortedKeys(m map[string]string) []string {
+	var l = make([]string, 0, len(m))
+	for k := range m {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func validateConditions(c *Conditions, path string) ValidationErrors {
+	var rv = ValidationErrors{}
+	for _, k := range sortedKeys(c.IfMatch) {
+		if _, err := regexp.Compile(c.IfMatch[k]); err != nil {
+			rv = append(rv, ValidationError{JoinPath(JoinPath(path, "if_match"), k), err.Error()})
+		}
+	}
+	for _, k := range sortedKeys(c.IfNotMatch) {
+		if _, err := regexp.Compile(c.IfNotMatch[k]); err != nil {
+			rv = append(rv, ValidationError{JoinPath(JoinPath(path, "if_not_match"), k), err.Error()})
+		}
+	}
+	for _, k := range sortedKeys(c.IfCompare) {
+		if _, err := makeComparison(k, c.IfCompare[k]); err != nil {
+			rv = append(rv, ValidationError{JoinPath(JoinPath(path, "if_compare"), k), err.Error()})
+		}
+	}
+	for i, g := range c.IfAny {
+		var p = fmt.Sprintf("%s[%d]", JoinPath(path, "if_any"), i)
+		if g == nil {
+			rv = append(rv, ValidationError{p, "empty condition group"})
+			continue
+		}
+		rv = append(rv, validateConditions(g, p)...)
+	}
+	return rv
+}
+
+// validateLabelMap checks the labels of a metric of type typ (empty for the
+// unique counters).
+func validateLabelMap(typ string, m LabelMap, path string) ValidationErrors {
+	var rv = ValidationErrors{}
+	var names = keys(m)
+	sort.Strings(names)
+	for _, k := range names {
+		var p = JoinPath(JoinPath(path, "label_map"), k)
+		if !labelNameRe.MatchString(k) || strings.HasPrefix(k, "__") {
+			rv = append(rv, ValidationError{p, fmt.Sprintf("invalid label name %q", k)})
+		}
+		if k == reservedLabels[typ] {
+			rv = append(rv, ValidationError{p, fmt.Sprintf("label name %q is reserved in %ss", k, typ)})
+		}
+		var s = m[k]
+		if s == nil || len(s.Field) == 0 {
+			rv = append(rv, ValidationError{p, "missing field"})
+			continue
+		}
+		if len(s.Regex) > 0 {
+			if _, err := regexp.Compile(s.Regex); err != nil {
+				rv = append(rv, ValidationError{JoinPath(p, "regex"), err.Error()})
+			}
+		}
+	}
+	return rv
+}
+
+func validateMetricName(name string, path string) ValidationErrors {
+	if !metricNameRe.MatchString(name) {
+		return ValidationErrors{{path, fmt.Sprintf("invalid metric name %q", name)}}
+	}
+	return nil
+}
+
+// ValidateMetrics checks the definitions of the standard metrics and
+// returns every problem found, sorted by path.
+func ValidateMetrics(config map[string]*MetricConfig, path string) ValidationErrors {
+	var rv = ValidationErrors{}
+	for name, v := range config {
+		var p = JoinPath(path, name)
+		rv = append(rv, validateMetricName(name, p)...)
+		if v == nil {
+			rv = append(rv, ValidationError{p, "missing definition"})
+			continue
+		}
+		var check = func(key string, err error) {
+			if err != nil {
+				rv = append(rv, ValidationError{JoinPath(p, key), err.Error()})
+			}
+		}
+		switch v.Type {
+		case "counter", "count":
+		case "summary":
+			_, err := summaryObjectives(v)
+			check("objectives", err)
+			_, err = summaryMaxAge(v)
+			check("max_age", err)
+			_, err = summaryAgeBuckets(v)
+			check("age_buckets", err)
+		case "histogram":
+			_, err := histogramBuckets(v)
+			check("buckets", err)
+		case "gauge":
+			_, err := gaugeMode(v)
+			check("gauge_mode", err)
+			if v.ResetInterval < 0 {
+				check("reset_interval", fmt.Errorf("must not be negative"))
+			}
+		case "":
+			check("type", fmt.Errorf("missing metric type"))
+		default:
+			check("type", fmt.Errorf("unsupported metric type %q", v.Type))
+		}
+		if len(v.ValueSource) == 0 && !countsLines(v) {
+			check("value_source", fmt.Errorf("missing value_source"))
+		}
+		if v.MaxSeries < 0 {
+			check("max_series", fmt.Errorf("must not be negative"))
+		}
+		if v.SeriesTTL < 0 {
+			check("series_ttl", fmt.Errorf("must not be negative"))
+		}
+		if v.ValueSplit != nil && len(v.ValueSource) == 0 && len(v.ValueSplit.Zip) == 0 {
+			check("value_split", fmt.Errorf("needs value_source or zip fields to split"))
+		}
+		rv = append(rv, validateLabelMap(v.Type, v.LabelMap, p)...)
+		rv = append(rv, validateConditions(&v.Conditions, p)...)
+	}
+	sort.SliceStable(rv, func(i, j int) bool { return rv[i].Path < rv[j].Path })
+	return rv
+}
+
+// ValidateUnique checks the definitions of the unique counters and returns
+// every problem found, sorted by path.
+func ValidateUnique(config map[string]*DistinctCounterConfig, path string) ValidationErrors {
+	var rv = ValidationErrors{}
+	for name, v := range config {
+		var p = JoinPath(path, name)
+		rv = append(rv, validateMetricName(name, p)...)
+		if v == nil {
+			rv = append(rv, ValidationError{p, "missing definition"})
+			continue
+		}
+		if len(strings.TrimSpace(strings.Replace(v.ValueSource, ",", "", -1))) == 0 {
+			rv = append(rv, ValidationError{JoinPath(p, "value_source"), "missing value_source"})
+		}
+		if v.TimeWindow <= 0 {
+			rv = append(rv, ValidationError{JoinPath(p, "time_window"), "must be positive"})
+		}
+		rv = append(rv, validateLabelMap("", v.LabelMap, p)...)
+		rv = append(rv, validateConditions(&v.Conditions, p)...)
+	}
+	sort.SliceStable(rv, func(i, j int) bool { return rv[i].Path < rv[j].Path })
+	return rv
+}